@@ -3,13 +3,18 @@ package run
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/henrywhitaker3/crunchy-users/internal/app"
+	"github.com/henrywhitaker3/crunchy-users/internal/health"
 	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
+	"github.com/henrywhitaker3/crunchy-users/internal/metrics"
 	"github.com/henrywhitaker3/crunchy-users/internal/postgres"
+	"github.com/henrywhitaker3/crunchy-users/internal/server"
 	"github.com/spf13/cobra"
 )
 
@@ -30,18 +35,39 @@ func NewCommand(app *app.App) *cobra.Command {
 				cancel()
 			}()
 
-			out, err := k8s.WatchClusters(ctx, app.Client)
+			probes := health.New(app.Config.LivenessTimeout)
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			mux.HandleFunc("/healthz", probes.Healthz)
+			mux.HandleFunc("/readyz", probes.Readyz)
+			go server.Serve(ctx, app.Config.HTTPAddress, mux)
+
+			out, synced, err := k8s.WatchClusters(ctx, app.Client, app.Events)
 			if err != nil {
 				return err
 			}
+			probes.SetSynced(synced)
+
+			// The loop marks itself as live whenever it is waiting
+			// on the channel, so it only stops being live when
+			// processing a cluster gets stuck
+			ticker := time.NewTicker(10 * time.Second)
+			defer ticker.Stop()
 
 			run := true
 			for run {
+				probes.Drained()
 				select {
 				case <-ctx.Done():
 					run = false
+				case <-ticker.C:
 				case res := <-out:
-					postgres.HandleCluster(ctx, res)
+					start := time.Now()
+					outcome, err := postgres.HandleCluster(ctx, res)
+					metrics.ObserveReconcile(res.Name, res.Namespace, time.Since(start), err != nil || len(outcome.Errors) > 0)
+					k8s.ReportPolicyStatus(ctx, app.Client, res, outcome.Errors, err)
+					app.Events.Report(res, outcome.Errors, outcome.Changes)
+					k8s.ReportClusterStatus(ctx, app.Client, res, outcome.Status(res, err))
 				}
 			}
 
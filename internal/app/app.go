@@ -11,6 +11,7 @@ type App struct {
 	Config  *config.Config
 
 	Client *dynamic.DynamicClient
+	Events *k8s.Events
 }
 
 func NewApp(version string) (*App, error) {
@@ -27,5 +28,15 @@ func NewApp(version string) (*App, error) {
 	}
 	app.Client = client
 
+	config, err := k8s.NewConfig(cfg.KubeconfigPath)
+	if err != nil {
+		return nil, err
+	}
+	events, err := k8s.NewEvents(config)
+	if err != nil {
+		return nil, err
+	}
+	app.Events = events
+
 	return app, nil
 }
@@ -2,12 +2,17 @@ package config
 
 import (
 	"context"
+	"time"
 
 	"github.com/sethvargo/go-envconfig"
 )
 
 type Config struct {
 	KubeconfigPath string `env:"KUBE_CONFIG_PATH,default=~/.kube/config"`
+	HTTPAddress    string `env:"HTTP_ADDRESS,default=:8080"`
+	// How long processing a cluster can take before the liveness
+	// probe fails
+	LivenessTimeout time.Duration `env:"LIVENESS_TIMEOUT,default=5m"`
 }
 
 func New() (*Config, error) {
@@ -0,0 +1,70 @@
+package health
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Tracks whether the process is ready to reconcile clusters, and
+// whether its reconcile loop is still running
+type Health struct {
+	mu      *sync.Mutex
+	synced  func() bool
+	drained time.Time
+	timeout time.Duration
+}
+
+// Creates a Health that stops being live when the reconcile loop
+// hasn't drained its channel for the timeout
+func New(timeout time.Duration) *Health {
+	return &Health{
+		mu:      &sync.Mutex{},
+		drained: time.Now(),
+		timeout: timeout,
+	}
+}
+
+// Sets the function that reports whether the informers have synced
+func (h *Health) SetSynced(synced func() bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.synced = synced
+}
+
+// Records that the reconcile loop is waiting to drain its channel
+func (h *Health) Drained() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drained = time.Now()
+}
+
+func (h *Health) Ready() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.synced != nil && h.synced()
+}
+
+func (h *Health) Live() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Since(h.drained) < h.timeout
+}
+
+func (h *Health) Healthz(w http.ResponseWriter, r *http.Request) {
+	respond(w, h.Live())
+}
+
+func (h *Health) Readyz(w http.ResponseWriter, r *http.Request) {
+	respond(w, h.Ready())
+}
+
+func respond(w http.ResponseWriter, ok bool) {
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ok"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
@@ -10,22 +10,46 @@ import (
 
 	crunchy "github.com/crunchydata/postgres-operator/pkg/apis/postgres-operator.crunchydata.com/v1"
 	"github.com/henrywhitaker3/crunchy-users/internal/logger"
+	"github.com/henrywhitaker3/crunchy-users/internal/metrics"
 	"github.com/henrywhitaker3/flow"
 	"go.uber.org/zap"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/tools/cache"
 )
 
 const (
-	WatchLabel           = "crunchy-users.henrywhitaker3.github.com/watch"
-	SuperuserAnnotation  = "crunchy-users.henrywhitaker3.github.com/superuser"
-	ExtensionsAnnotation = "crunchy-users.henrywhitaker3.github.com/extensions"
+	WatchLabel                  = "crunchy-users.henrywhitaker3.github.com/watch"
+	SuperuserAnnotation         = "crunchy-users.henrywhitaker3.github.com/superuser"
+	ExtensionsAnnotation        = "crunchy-users.henrywhitaker3.github.com/extensions"
+	SchemasAnnotation           = "crunchy-users.henrywhitaker3.github.com/schemas"
+	DefaultPrivilegesAnnotation = "crunchy-users.henrywhitaker3.github.com/default-privileges"
+	GrantsAnnotation            = "crunchy-users.henrywhitaker3.github.com/grants"
+	PruneExtensionsAnnotation   = "crunchy-users.henrywhitaker3.github.com/prune-extensions"
+	RolesAnnotation             = "crunchy-users.henrywhitaker3.github.com/roles"
+	MembershipsAnnotation       = "crunchy-users.henrywhitaker3.github.com/memberships"
+	DatabaseSettingsAnnotation  = "crunchy-users.henrywhitaker3.github.com/database-settings"
+	RoleSettingsAnnotation      = "crunchy-users.henrywhitaker3.github.com/role-settings"
+	ReassignObjectsAnnotation   = "crunchy-users.henrywhitaker3.github.com/reassign-objects"
+	HardenAnnotation            = "crunchy-users.henrywhitaker3.github.com/harden"
+	DatabasesAnnotation         = "crunchy-users.henrywhitaker3.github.com/databases"
+	MigrationsAnnotation        = "crunchy-users.henrywhitaker3.github.com/migrations"
+	CronJobsAnnotation          = "crunchy-users.henrywhitaker3.github.com/cron-jobs"
+	ForeignServersAnnotation    = "crunchy-users.henrywhitaker3.github.com/foreign-servers"
+	PublicationsAnnotation      = "crunchy-users.henrywhitaker3.github.com/publications"
+	SubscriptionsAnnotation     = "crunchy-users.henrywhitaker3.github.com/subscriptions"
+	CDCAnnotation               = "crunchy-users.henrywhitaker3.github.com/cdc"
+	StatusAnnotation            = "crunchy-users.henrywhitaker3.github.com/status"
+	AllowedNamespacesAnnotation = "crunchy-users.henrywhitaker3.github.com/allowed-namespaces"
+	HardenTemporaryAnnotation   = "crunchy-users.henrywhitaker3.github.com/harden-revoke-temporary"
+	PruneCascadeAnnotation      = "crunchy-users.henrywhitaker3.github.com/prune-extensions-cascade"
 )
 
 var (
@@ -41,6 +65,110 @@ type DatabaseExtension struct {
 	Database  string `json:"database"`
 	Extension string `json:"extension"`
 	Cascade   bool   `json:"cascade"`
+	Version   string `json:"version"`
+	Schema    string `json:"schema"`
+}
+
+type DatabaseSchema struct {
+	Database      string `json:"database"`
+	Schema        string `json:"schema"`
+	Owner         string `json:"owner"`
+	Authorization string `json:"authorization"`
+}
+
+// The role that should own the schema, which falls back to the
+// authorization user when no explicit owner has been set
+func (s DatabaseSchema) DesiredOwner() string {
+	if s.Owner != "" {
+		return s.Owner
+	}
+	return s.Authorization
+}
+
+// The privileges granted by default on objects created by the
+// grantor in the schema, applied using ALTER DEFAULT PRIVILEGES
+type DefaultPrivilege struct {
+	Database  string   `json:"database"`
+	Schema    string   `json:"schema"`
+	Grantor   string   `json:"grantor"`
+	Grantee   string   `json:"grantee"`
+	Tables    []string `json:"tables"`
+	Sequences []string `json:"sequences"`
+	Functions []string `json:"functions"`
+}
+
+// The level of access a user should have to a database it
+// doesn't own, one of connect, read, readwrite or all
+type DatabaseGrant struct {
+	Database string   `json:"database"`
+	User     string   `json:"user"`
+	Level    string   `json:"level"`
+	Schemas  []string `json:"schemas"`
+}
+
+// The schemas the grant applies to, which defaults to public
+func (g DatabaseGrant) GrantSchemas() []string {
+	if len(g.Schemas) == 0 {
+		return []string{"public"}
+	}
+	return g.Schemas
+}
+
+// The attributes a user's role should have. Attributes that are
+// not set are left as they are.
+type RoleAttributes struct {
+	User            string `json:"user"`
+	ConnectionLimit *int   `json:"connectionLimit"`
+	CreateDB        *bool  `json:"createdb"`
+	CreateRole      *bool  `json:"createrole"`
+	BypassRLS       *bool  `json:"bypassrls"`
+	Replication     *bool  `json:"replication"`
+	// An RFC3339 timestamp, or infinity for no expiry
+	ValidUntil *string `json:"validUntil"`
+}
+
+// The roles a user should be a member of, which can be group
+// roles or predefined roles such as pg_monitor
+type RoleMembership struct {
+	User  string   `json:"user"`
+	Roles []string `json:"roles"`
+}
+
+// The configuration parameters set on a database with
+// ALTER DATABASE ... SET
+type DatabaseSettings struct {
+	Database string            `json:"database"`
+	Settings map[string]string `json:"settings"`
+}
+
+// The configuration parameters set on a role with ALTER ROLE ...
+// SET, optionally only when connected to a specific database
+type RoleSettings struct {
+	User     string            `json:"user"`
+	Database string            `json:"database"`
+	Settings map[string]string `json:"settings"`
+}
+
+// A database that should be created with the given options when
+// it doesn't exist. Options that are empty use the server default.
+type DatabaseSpec struct {
+	Database  string `json:"database"`
+	Owner     string `json:"owner"`
+	Template  string `json:"template"`
+	Encoding  string `json:"encoding"`
+	LcCollate string `json:"lcCollate"`
+	LcCtype   string `json:"lcCtype"`
+	IcuLocale string `json:"icuLocale"`
+}
+
+// A pg_cron job, identified by its name, that runs the command in
+// the database on the schedule as the owner
+type CronJob struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	Database string `json:"database"`
+	Command  string `json:"command"`
+	Owner    string `json:"owner"`
 }
 
 type ClusterSuperuser struct {
@@ -67,11 +195,44 @@ func (c ClusterSuperuser) Key() string {
 }
 
 type ClusterResult struct {
-	Name       string
-	Namespace  string
-	Superuser  ClusterSuperuser
-	Users      []ClusterUser
-	Extensions map[string][]DatabaseExtension
+	Name              string
+	Namespace         string
+	UID               types.UID
+	Generation        int64
+	Superuser         ClusterSuperuser
+	Users             []ClusterUser
+	Extensions        map[string][]DatabaseExtension
+	Schemas           map[string][]DatabaseSchema
+	DefaultPrivileges map[string][]DefaultPrivilege
+	Grants            map[string][]DatabaseGrant
+	Roles             map[string]RoleAttributes
+	Memberships       map[string]RoleMembership
+	DatabaseSettings  map[string]DatabaseSettings
+	RoleSettings      map[string][]RoleSettings
+	Databases         []DatabaseSpec
+	Migrations        map[string][]Migration
+	CronJobs          []CronJob
+	ForeignServers    map[string][]ForeignServer
+	Publications      map[string][]Publication
+	Subscriptions     map[string][]Subscription
+	CDC               map[string][]CDC
+
+	// The DatabaseAccessPolicies that were merged into the result
+	Policies []DatabaseAccessPolicy
+
+	// Whether extensions installed by crunchy-users that are no
+	// longer declared should be dropped, and whether to cascade
+	PruneExtensions        bool
+	PruneExtensionsCascade bool
+
+	// Whether objects owned by the superuser in each database should
+	// be reassigned to the database owner
+	ReassignObjects bool
+
+	// Whether PUBLIC access to managed databases should be revoked,
+	// and whether that includes TEMPORARY
+	Harden                bool
+	HardenRevokeTemporary bool
 }
 
 func (c ClusterResult) Key() string {
@@ -81,7 +242,8 @@ func (c ClusterResult) Key() string {
 func WatchClusters(
 	ctx context.Context,
 	client *dynamic.DynamicClient,
-) (<-chan ClusterResult, error) {
+	events *Events,
+) (<-chan ClusterResult, cache.InformerSynced, error) {
 	logger := logger.Logger(ctx)
 
 	out := make(chan ClusterResult, 1)
@@ -93,26 +255,111 @@ func WatchClusters(
 		nil,
 	)
 	informer := fac.ForResource(crunchy.GroupVersion.WithResource("postgresclusters")).Informer()
+
+	// The policy informer never syncs without the CRD, so policies
+	// are ignored rather than holding up readiness when it hasn't
+	// been applied
+	served, err := policiesServed(ctx, client)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not list database access policies: %w", err)
+	}
+	var policyInformer cache.SharedIndexInformer
+	policies := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	if served {
+		policyInformer = fac.ForResource(PolicyResource).Informer()
+		policies = policyInformer.GetStore()
+	} else {
+		logger.Warn("the DatabaseAccessPolicy CRD has not been applied, so policies are ignored until it is and crunchy-users is restarted")
+	}
 	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj any) {
+			countWatched(informer.GetStore())
 			u := obj.(*unstructured.Unstructured)
-			cluster := processObject(ctx, logger, u, client)
+			cluster := processObject(ctx, logger, u, client, policies, events)
 			if cluster != nil {
 				out <- *cluster
 			}
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			u := newObj.(*unstructured.Unstructured)
-			cluster := processObject(ctx, logger, u, client)
+			if onlyStatusChanged(oldObj.(*unstructured.Unstructured), u) {
+				return
+			}
+			countWatched(informer.GetStore())
+			cluster := processObject(ctx, logger, u, client, policies, events)
 			if cluster != nil {
 				out <- *cluster
 			}
 		},
+		DeleteFunc: func(obj any) {
+			countWatched(informer.GetStore())
+		},
 	})
+
+	// Changes to a policy re-process the cluster it references, so
+	// they are picked up without waiting for the cluster to change
+	reprocess := func(obj any) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return
+		}
+		name, _, _ := unstructured.NestedString(u.Object, "spec", "clusterName")
+		cobj, exists, err := informer.GetStore().GetByKey(fmt.Sprintf("%s/%s", u.GetNamespace(), name))
+		if err != nil || !exists {
+			return
+		}
+		cluster := processObject(ctx, logger, cobj.(*unstructured.Unstructured), client, policies, events)
+		if cluster != nil {
+			out <- *cluster
+		}
+	}
+	if policyInformer != nil {
+		policyInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: reprocess,
+			UpdateFunc: func(oldObj, newObj any) {
+				// Status updates from reporting the outcome don't
+				// change the generation
+				if oldObj.(*unstructured.Unstructured).GetGeneration() == newObj.(*unstructured.Unstructured).GetGeneration() {
+					return
+				}
+				reprocess(newObj)
+			},
+			DeleteFunc: reprocess,
+		})
+		go policyInformer.Run(ctx.Done())
+	}
+
 	logger.Infow("watching clusters")
 	go informer.Run(ctx.Done())
 
-	return out, nil
+	synced := func() bool {
+		return informer.HasSynced() && (policyInformer == nil || policyInformer.HasSynced())
+	}
+	return out, synced, nil
+}
+
+// Whether the DatabaseAccessPolicy CRD has been applied, so the
+// resource is served by the API
+func policiesServed(ctx context.Context, client dynamic.Interface) (bool, error) {
+	_, err := client.Resource(PolicyResource).List(ctx, v1.ListOptions{Limit: 1})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Updates the number of watched clusters in the store
+func countWatched(store cache.Store) {
+	watched := 0
+	for _, obj := range store.List() {
+		if u, ok := obj.(*unstructured.Unstructured); ok && u.GetLabels()[WatchLabel] == "true" {
+			watched++
+		}
+	}
+	metrics.WatchedClusters.Set(float64(watched))
 }
 
 func processObject(
@@ -120,6 +367,8 @@ func processObject(
 	logger *zap.SugaredLogger,
 	u *unstructured.Unstructured,
 	client *dynamic.DynamicClient,
+	policyStore cache.Store,
+	events *Events,
 ) *ClusterResult {
 	cluster := &crunchy.PostgresCluster{}
 	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), cluster); err != nil {
@@ -133,24 +382,83 @@ func processObject(
 		l.Infow("skipping cluster as it is not being watched")
 		return nil
 	}
+	l = events.warnings(l, cluster)
 	superName, ok := cluster.Annotations[SuperuserAnnotation]
 	if !ok {
 		l.Errorw("skipping cluster as superuser annotation not set")
 		return nil
 	}
 
-	ext := []DatabaseExtension{}
-	extRaw, ok := cluster.Annotations[ExtensionsAnnotation]
-	if ok {
-		if err := json.Unmarshal([]byte(extRaw), &ext); err != nil {
-			l.Errorw("failed to unmarshall extensions", "error", err)
-		}
+	extensions := byDatabase(
+		unmarshalAnnotation[DatabaseExtension](l, cluster, ExtensionsAnnotation, "extensions"),
+		func(e DatabaseExtension) string { return e.Database },
+	)
+	schemas := byDatabase(
+		unmarshalAnnotation[DatabaseSchema](l, cluster, SchemasAnnotation, "schemas"),
+		func(s DatabaseSchema) string { return s.Database },
+	)
+	defaultPrivileges := byDatabase(
+		unmarshalAnnotation[DefaultPrivilege](l, cluster, DefaultPrivilegesAnnotation, "default privileges"),
+		func(d DefaultPrivilege) string { return d.Database },
+	)
+	grants := byDatabase(
+		unmarshalAnnotation[DatabaseGrant](l, cluster, GrantsAnnotation, "grants"),
+		func(g DatabaseGrant) string { return g.Database },
+	)
+
+	roles := map[string]RoleAttributes{}
+	for _, r := range unmarshalAnnotation[RoleAttributes](l, cluster, RolesAnnotation, "roles") {
+		roles[r.User] = r
 	}
-	extensions := map[string][]DatabaseExtension{}
-	for _, e := range ext {
-		extensions[e.Database] = append(extensions[e.Database], e)
+
+	memberships := map[string]RoleMembership{}
+	for _, m := range unmarshalAnnotation[RoleMembership](l, cluster, MembershipsAnnotation, "memberships") {
+		memberships[m.User] = m
+	}
+
+	databaseSettings := map[string]DatabaseSettings{}
+	for _, d := range unmarshalAnnotation[DatabaseSettings](l, cluster, DatabaseSettingsAnnotation, "database settings") {
+		databaseSettings[d.Database] = d
 	}
 
+	roleSettings := map[string][]RoleSettings{}
+	for _, r := range unmarshalAnnotation[RoleSettings](l, cluster, RoleSettingsAnnotation, "role settings") {
+		roleSettings[r.User] = append(roleSettings[r.User], r)
+	}
+
+	databases := unmarshalAnnotation[DatabaseSpec](l, cluster, DatabasesAnnotation, "databases")
+	migrations := getMigrations(
+		ctx,
+		l,
+		client,
+		cluster,
+		unmarshalAnnotation[DatabaseMigrations](l, cluster, MigrationsAnnotation, "migrations"),
+	)
+
+	cronJobs := unmarshalAnnotation[CronJob](l, cluster, CronJobsAnnotation, "cron jobs")
+	foreignServers := getForeignServers(
+		ctx,
+		l,
+		client,
+		cluster,
+		unmarshalAnnotation[ForeignServer](l, cluster, ForeignServersAnnotation, "foreign servers"),
+	)
+	publications := byDatabase(
+		unmarshalAnnotation[Publication](l, cluster, PublicationsAnnotation, "publications"),
+		func(p Publication) string { return p.Database },
+	)
+	subscriptions := getSubscriptions(
+		ctx,
+		l,
+		client,
+		cluster,
+		unmarshalAnnotation[Subscription](l, cluster, SubscriptionsAnnotation, "subscriptions"),
+	)
+	cdc := byDatabase(
+		unmarshalAnnotation[CDC](l, cluster, CDCAnnotation, "cdc"),
+		func(c CDC) string { return c.Database },
+	)
+
 	users := []ClusterUser{}
 	for _, user := range cluster.Spec.Users {
 		dbs := []string{}
@@ -163,11 +471,14 @@ func processObject(
 		})
 	}
 
-	if len(users) < 1 && len(extensions) < 1 {
-		l.Infow("skipping cluster as there are no users or extensions")
-		return nil
+	policies := policiesFor(policyStore, cluster)
+	for _, policy := range policies {
+		users = policy.merge(users, extensions, schemas, grants)
 	}
 
+	// Clusters are processed even when nothing is declared, as what
+	// crunchy-users recorded before, e.g. grants and settings, still
+	// has to be cleaned up once it is removed from the annotations
 	super, err := getSuperuser(ctx, client, cluster, superName)
 	if err != nil {
 		l.Errorw("skipping, could not get super user credentials", "error", err)
@@ -175,31 +486,101 @@ func processObject(
 	}
 
 	return &ClusterResult{
-		Name:       cluster.Name,
-		Namespace:  cluster.Namespace,
-		Superuser:  super,
-		Users:      users,
-		Extensions: extensions,
+		Name:              cluster.Name,
+		Namespace:         cluster.Namespace,
+		UID:               cluster.UID,
+		Generation:        cluster.Generation,
+		Superuser:         super,
+		Users:             users,
+		Extensions:        extensions,
+		Schemas:           schemas,
+		DefaultPrivileges: defaultPrivileges,
+		Grants:            grants,
+		Roles:             roles,
+		Memberships:       memberships,
+		DatabaseSettings:  databaseSettings,
+		RoleSettings:      roleSettings,
+		Databases:         databases,
+		Migrations:        migrations,
+		CronJobs:          cronJobs,
+		ForeignServers:    foreignServers,
+		Publications:      publications,
+		Subscriptions:     subscriptions,
+		CDC:               cdc,
+		Policies:          policies,
+
+		PruneExtensions:        cluster.Annotations[PruneExtensionsAnnotation] == "true",
+		PruneExtensionsCascade: cluster.Annotations[PruneCascadeAnnotation] == "true",
+
+		ReassignObjects: cluster.Annotations[ReassignObjectsAnnotation] == "true",
+
+		Harden:                cluster.Annotations[HardenAnnotation] == "true",
+		HardenRevokeTemporary: cluster.Annotations[HardenTemporaryAnnotation] == "true",
 	}
 }
 
+// Unmarshals the json array stored in the annotation, logging
+// when it is malformed
+func unmarshalAnnotation[T any](
+	logger *zap.SugaredLogger,
+	cluster *crunchy.PostgresCluster,
+	annotation string,
+	kind string,
+) []T {
+	out := []T{}
+	raw, ok := cluster.Annotations[annotation]
+	if !ok {
+		return out
+	}
+	if err := json.Unmarshal([]byte(raw), &out); err != nil {
+		logger.Errorw(fmt.Sprintf("failed to unmarshall %s", kind), "error", err)
+	}
+	return out
+}
+
+func byDatabase[T any](items []T, database func(T) string) map[string][]T {
+	out := map[string][]T{}
+	for _, item := range items {
+		out[database(item)] = append(out[database(item)], item)
+	}
+	return out
+}
+
 func getSuperuser(
 	ctx context.Context,
 	client *dynamic.DynamicClient,
 	cluster *crunchy.PostgresCluster,
 	name string,
 ) (ClusterSuperuser, error) {
-	var out ClusterSuperuser
 	if url, ok := superusers.Get(clusterKey(cluster)); ok {
 		return url, nil
 	}
 
-	secretName := fmt.Sprintf("%s-pguser-%s", cluster.Name, name)
+	out, err := getUserCredentials(ctx, client, cluster.Namespace, cluster.Name, name)
+	if err != nil {
+		return out, err
+	}
+	superusers.Put(clusterKey(cluster), out)
+
+	return out, nil
+}
+
+// Reads the connection details for a user from the secret crunchy
+// creates for it
+func getUserCredentials(
+	ctx context.Context,
+	client *dynamic.DynamicClient,
+	namespace string,
+	cluster string,
+	name string,
+) (ClusterSuperuser, error) {
+	var out ClusterSuperuser
+	secretName := fmt.Sprintf("%s-pguser-%s", cluster, name)
 	usec, err := client.Resource(schema.GroupVersionResource{
 		Group:    "",
 		Version:  "v1",
 		Resource: "secrets",
-	}).Namespace(cluster.Namespace).Get(ctx, secretName, v1.GetOptions{})
+	}).Namespace(namespace).Get(ctx, secretName, v1.GetOptions{})
 	if err != nil {
 		return out, err
 	}
@@ -211,12 +592,12 @@ func getSuperuser(
 
 	host, ok := secret.Data["host"]
 	if !ok {
-		return out, errors.New("superuser secret missing field host")
+		return out, errors.New("user secret missing field host")
 	}
 	out.Host = string(host)
 	portB, ok := secret.Data["port"]
 	if !ok {
-		return out, errors.New("superuser secret missing field port")
+		return out, errors.New("user secret missing field port")
 	}
 	port, err := strconv.Atoi(string(portB))
 	if err != nil {
@@ -225,22 +606,20 @@ func getSuperuser(
 	out.Port = port
 	user, ok := secret.Data["user"]
 	if !ok {
-		return out, errors.New("superuser secret missing field user")
+		return out, errors.New("user secret missing field user")
 	}
 	out.User = string(user)
 	dbname, ok := secret.Data["dbname"]
 	if !ok {
-		return out, errors.New("superuser secret missing field dbname")
+		return out, errors.New("user secret missing field dbname")
 	}
 	out.Database = string(dbname)
 	password, ok := secret.Data["password"]
 	if !ok {
-		return out, errors.New("superuser secret missing field password")
+		return out, errors.New("user secret missing field password")
 	}
 	out.Password = string(password)
 
-	superusers.Put(clusterKey(cluster), out)
-
 	return out, nil
 }
 
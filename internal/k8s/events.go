@@ -0,0 +1,169 @@
+package k8s
+
+import (
+	"fmt"
+	"slices"
+	"time"
+	"unicode/utf8"
+
+	crunchy "github.com/crunchydata/postgres-operator/pkg/apis/postgres-operator.crunchydata.com/v1"
+	"github.com/henrywhitaker3/flow"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	EventReasonInvalid = "InvalidConfiguration"
+	EventReasonFailed  = "ReconcileFailed"
+	EventReasonApplied = "Applied"
+
+	// How long an event is held back for after it has been recorded,
+	// so the informer's resync doesn't record the same one every time
+	eventInterval = time.Hour
+	// Events with longer messages are rejected by the API
+	maxEventMessage = 1024
+)
+
+// Records events against PostgresClusters. Repeats of an event are
+// only recorded once an hour, and the broadcaster's correlator
+// aggregates and rate limits the rest. A nil Events records nothing.
+type Events struct {
+	recorder record.EventRecorder
+	sent     *flow.ExpiringStore[struct{}]
+}
+
+func NewEvents(config *rest.Config) (*Events, error) {
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return &Events{
+		recorder: broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "crunchy-users"}),
+		sent:     flow.NewExpiringStore[struct{}](),
+	}, nil
+}
+
+func (e *Events) record(ref *corev1.ObjectReference, eventType, reason, message string) {
+	if e == nil {
+		return
+	}
+	if len(message) > maxEventMessage {
+		// Cut on a rune boundary so the message stays valid UTF-8
+		n := maxEventMessage
+		for n > 0 && !utf8.RuneStart(message[n]) {
+			n--
+		}
+		message = message[:n]
+	}
+	key := fmt.Sprintf("%s/%s:%s:%s:%s", ref.Namespace, ref.Name, eventType, reason, message)
+	if _, ok := e.sent.Get(key); ok {
+		return
+	}
+	e.sent.Put(key, struct{}{}, eventInterval)
+	e.recorder.Event(ref, eventType, reason, message)
+}
+
+// Records a Warning event for each failure and a Normal event for
+// each change made while processing the cluster
+func (e *Events) Report(cluster ClusterResult, failures map[string][]string, changes map[string][]string) {
+	ref := cluster.reference()
+	for _, database := range sortedKeys(failures) {
+		for _, message := range failures[database] {
+			e.record(ref, corev1.EventTypeWarning, EventReasonFailed, withDatabase(database, message))
+		}
+	}
+	for _, database := range sortedKeys(changes) {
+		for _, message := range changes[database] {
+			e.record(ref, corev1.EventTypeNormal, EventReasonApplied, withDatabase(database, message))
+		}
+	}
+}
+
+// Wraps the logger so the errors logged through it are also recorded
+// as Warning events on the cluster
+func (e *Events) warnings(logger *zap.SugaredLogger, cluster *crunchy.PostgresCluster) *zap.SugaredLogger {
+	if e == nil {
+		return logger
+	}
+	core := &warningCore{events: e, ref: clusterReference(cluster.Name, cluster.Namespace, cluster.UID)}
+	return logger.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(c, core)
+	}))
+}
+
+// Records the errors logged through it as Warning events, with the
+// error that was logged alongside the message
+type warningCore struct {
+	events *Events
+	ref    *corev1.ObjectReference
+	fields []zapcore.Field
+}
+
+func (w *warningCore) Enabled(level zapcore.Level) bool {
+	return level >= zapcore.ErrorLevel
+}
+
+func (w *warningCore) With(fields []zapcore.Field) zapcore.Core {
+	return &warningCore{events: w.events, ref: w.ref, fields: append(append([]zapcore.Field{}, w.fields...), fields...)}
+}
+
+func (w *warningCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if w.Enabled(entry.Level) {
+		return checked.AddCore(entry, w)
+	}
+	return checked
+}
+
+func (w *warningCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	message := entry.Message
+	for _, field := range append(append([]zapcore.Field{}, w.fields...), fields...) {
+		if err, ok := field.Interface.(error); ok && field.Type == zapcore.ErrorType {
+			message = fmt.Sprintf("%s: %s", message, err)
+		}
+	}
+	w.events.record(w.ref, corev1.EventTypeWarning, EventReasonInvalid, message)
+	return nil
+}
+
+func (w *warningCore) Sync() error {
+	return nil
+}
+
+func (c ClusterResult) reference() *corev1.ObjectReference {
+	return clusterReference(c.Name, c.Namespace, c.UID)
+}
+
+func clusterReference(name, namespace string, uid types.UID) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: crunchy.GroupVersion.String(),
+		Kind:       "PostgresCluster",
+		Name:       name,
+		Namespace:  namespace,
+		UID:        uid,
+	}
+}
+
+func withDatabase(database, message string) string {
+	if database == "" {
+		return message
+	}
+	return fmt.Sprintf("database %s: %s", database, message)
+}
+
+func sortedKeys[T any](in map[string]T) []string {
+	keys := []string{}
+	for key := range in {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
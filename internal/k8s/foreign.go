@@ -0,0 +1,110 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	crunchy "github.com/crunchydata/postgres-operator/pkg/apis/postgres-operator.crunchydata.com/v1"
+	"go.uber.org/zap"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+)
+
+// A postgres_fdw server in a database that points at another
+// PostgresCluster, connecting as one of that cluster's users
+type ForeignServer struct {
+	Database string `json:"database"`
+	Server   string `json:"server"`
+	// The source PostgresCluster, in this cluster's namespace unless
+	// one is set
+	Cluster   string `json:"cluster"`
+	Namespace string `json:"namespace"`
+	User      string `json:"user"`
+	// The database to connect to, defaults to the one in the user's
+	// secret
+	RemoteDatabase string `json:"remoteDatabase"`
+	// The local role the user mapping is for, which is required so
+	// the mapping isn't for every role by accident. It can be set to
+	// PUBLIC explicitly.
+	LocalUser string `json:"localUser"`
+	// When set, the remote schema is imported into the local schema
+	ImportSchema string `json:"importSchema"`
+	IntoSchema   string `json:"intoSchema"`
+
+	// The source user's connection details, read from its secret
+	Credentials ClusterSuperuser `json:"-"`
+}
+
+// Reads the credentials for each foreign server from the source
+// cluster's secret. They aren't cached, so rotated passwords are
+// picked up the next time the cluster is processed. Servers without
+// a local user, with a source that isn't allowed or with credentials
+// that can't be read are left out.
+func getForeignServers(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	client *dynamic.DynamicClient,
+	cluster *crunchy.PostgresCluster,
+	declared []ForeignServer,
+) map[string][]ForeignServer {
+	out := map[string][]ForeignServer{}
+	for _, server := range declared {
+		if server.Namespace == "" {
+			server.Namespace = cluster.Namespace
+		}
+		l := logger.With("server", server.Server, "source", server.Cluster, "source_namespace", server.Namespace)
+		if server.LocalUser == "" {
+			l.Errorw("skipping foreign server as localUser is not set")
+			continue
+		}
+		if err := sourceAllowed(ctx, client, cluster, server.Namespace, server.Cluster); err != nil {
+			l.Errorw("skipping foreign server as the source cluster can't be used", "error", err)
+			continue
+		}
+		creds, err := getUserCredentials(ctx, client, server.Namespace, server.Cluster, server.User)
+		if err != nil {
+			l.Errorw("could not get foreign server credentials", "error", err)
+			continue
+		}
+		server.Credentials = creds
+		if server.RemoteDatabase == "" {
+			server.RemoteDatabase = creds.Database
+		}
+		out[server.Database] = append(out[server.Database], server)
+	}
+	return out
+}
+
+// Checks that this cluster can use the credentials of another
+// cluster's users. The source has to be watched, and a source in a
+// different namespace has to list this cluster's namespace in its
+// allowed-namespaces annotation, so it can't be read from anywhere.
+func sourceAllowed(
+	ctx context.Context,
+	client *dynamic.DynamicClient,
+	cluster *crunchy.PostgresCluster,
+	namespace string,
+	name string,
+) error {
+	source, err := client.Resource(crunchy.GroupVersion.WithResource("postgresclusters")).Namespace(namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get source cluster: %w", err)
+	}
+	if source.GetLabels()[WatchLabel] != "true" {
+		return errors.New("source cluster is not being watched")
+	}
+	if namespace == cluster.Namespace {
+		return nil
+	}
+	allowed := []string{}
+	for _, ns := range strings.Split(source.GetAnnotations()[AllowedNamespacesAnnotation], ",") {
+		allowed = append(allowed, strings.TrimSpace(ns))
+	}
+	if !slices.Contains(allowed, cluster.Namespace) {
+		return fmt.Errorf("source cluster does not allow namespace %s", cluster.Namespace)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package k8s
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+
+	crunchy "github.com/crunchydata/postgres-operator/pkg/apis/postgres-operator.crunchydata.com/v1"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// Points a database at a ConfigMap in the cluster's namespace
+// containing the SQL files to apply to it
+type DatabaseMigrations struct {
+	Database  string `json:"database"`
+	ConfigMap string `json:"configMap"`
+}
+
+// A single SQL file from a migrations ConfigMap, where the version
+// is the key of the file in the ConfigMap
+type Migration struct {
+	Version string
+	SQL     string
+}
+
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.SQL))
+	return hex.EncodeToString(sum[:])
+}
+
+// Reads the migrations for each database from their ConfigMaps,
+// ordered by their key. Databases with a ConfigMap that can't be
+// read are left out.
+func getMigrations(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	client *dynamic.DynamicClient,
+	cluster *crunchy.PostgresCluster,
+	declared []DatabaseMigrations,
+) map[string][]Migration {
+	out := map[string][]Migration{}
+	for _, d := range declared {
+		l := logger.With("database", d.Database, "configmap", d.ConfigMap)
+		cm, err := getConfigMap(ctx, client, cluster.Namespace, d.ConfigMap)
+		if err != nil {
+			l.Errorw("could not get migrations configmap", "error", err)
+			continue
+		}
+		versions := []string{}
+		for version := range cm.Data {
+			versions = append(versions, version)
+		}
+		slices.Sort(versions)
+		for _, version := range versions {
+			out[d.Database] = append(out[d.Database], Migration{
+				Version: version,
+				SQL:     cm.Data[version],
+			})
+		}
+	}
+	return out
+}
+
+func getConfigMap(
+	ctx context.Context,
+	client *dynamic.DynamicClient,
+	namespace string,
+	name string,
+) (*corev1.ConfigMap, error) {
+	u, err := client.Resource(schema.GroupVersionResource{
+		Group:    "",
+		Version:  "v1",
+		Resource: "configmaps",
+	}).Namespace(namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	cm := &corev1.ConfigMap{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), cm); err != nil {
+		return nil, err
+	}
+	return cm, nil
+}
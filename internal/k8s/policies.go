@@ -0,0 +1,203 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+
+	crunchy "github.com/crunchydata/postgres-operator/pkg/apis/postgres-operator.crunchydata.com/v1"
+	"github.com/henrywhitaker3/crunchy-users/internal/logger"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	PolicyReadyCondition = "Ready"
+)
+
+var (
+	PolicyGroupVersion = schema.GroupVersion{
+		Group:   "crunchy-users.henrywhitaker3.github.com",
+		Version: "v1alpha1",
+	}
+	PolicyResource = PolicyGroupVersion.WithResource("databaseaccesspolicies")
+)
+
+// Declares the extensions, ownership and grants for databases in a
+// PostgresCluster in the same namespace, as a typed alternative to
+// the annotations. They are merged with the cluster's annotations.
+type DatabaseAccessPolicy struct {
+	v1.TypeMeta   `json:",inline"`
+	v1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DatabaseAccessPolicySpec   `json:"spec"`
+	Status DatabaseAccessPolicyStatus `json:"status,omitempty"`
+}
+
+type DatabaseAccessPolicySpec struct {
+	// The name of the PostgresCluster the policy applies to
+	ClusterName string              `json:"clusterName"`
+	Owners      []DatabaseOwner     `json:"owners,omitempty"`
+	Extensions  []DatabaseExtension `json:"extensions,omitempty"`
+	Schemas     []DatabaseSchema    `json:"schemas,omitempty"`
+	Grants      []DatabaseGrant     `json:"grants,omitempty"`
+}
+
+// A database that should be owned by the user, as if the user
+// listed it in spec.users
+type DatabaseOwner struct {
+	Database string `json:"database"`
+	User     string `json:"user"`
+}
+
+type DatabaseAccessPolicyStatus struct {
+	Databases []DatabasePolicyStatus `json:"databases,omitempty"`
+}
+
+type DatabasePolicyStatus struct {
+	Database   string         `json:"database"`
+	Conditions []v1.Condition `json:"conditions,omitempty"`
+}
+
+// The databases the policy declares anything for
+func (p DatabaseAccessPolicy) Databases() []string {
+	out := []string{}
+	add := func(database string) {
+		if !slices.Contains(out, database) {
+			out = append(out, database)
+		}
+	}
+	for _, o := range p.Spec.Owners {
+		add(o.Database)
+	}
+	for _, e := range p.Spec.Extensions {
+		add(e.Database)
+	}
+	for _, s := range p.Spec.Schemas {
+		add(s.Database)
+	}
+	for _, g := range p.Spec.Grants {
+		add(g.Database)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// Merges the policy into the declarations from the cluster, returning
+// the users with the policy's owners added
+func (p DatabaseAccessPolicy) merge(
+	users []ClusterUser,
+	extensions map[string][]DatabaseExtension,
+	schemas map[string][]DatabaseSchema,
+	grants map[string][]DatabaseGrant,
+) []ClusterUser {
+	for _, o := range p.Spec.Owners {
+		i := slices.IndexFunc(users, func(u ClusterUser) bool { return u.Name == o.User })
+		if i < 0 {
+			users = append(users, ClusterUser{Name: o.User})
+			i = len(users) - 1
+		}
+		if !slices.Contains(users[i].Databases, o.Database) {
+			users[i].Databases = append(users[i].Databases, o.Database)
+		}
+	}
+	for _, e := range p.Spec.Extensions {
+		extensions[e.Database] = append(extensions[e.Database], e)
+	}
+	for _, s := range p.Spec.Schemas {
+		schemas[s.Database] = append(schemas[s.Database], s)
+	}
+	for _, g := range p.Spec.Grants {
+		grants[g.Database] = append(grants[g.Database], g)
+	}
+	return users
+}
+
+// Returns the policies in the store that reference the cluster
+func policiesFor(store cache.Store, cluster *crunchy.PostgresCluster) []DatabaseAccessPolicy {
+	out := []DatabaseAccessPolicy{}
+	for _, obj := range store.List() {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok || u.GetNamespace() != cluster.Namespace {
+			continue
+		}
+		policy := DatabaseAccessPolicy{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &policy); err != nil {
+			continue
+		}
+		if policy.Spec.ClusterName == cluster.Name {
+			out = append(out, policy)
+		}
+	}
+	slices.SortFunc(out, func(a, b DatabaseAccessPolicy) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return out
+}
+
+// Sets the Ready condition for each of the databases in the cluster's
+// policies, from the errors logged for them while it was processed.
+// When the cluster couldn't be processed at all, every database is
+// not ready.
+func ReportPolicyStatus(
+	ctx context.Context,
+	client *dynamic.DynamicClient,
+	cluster ClusterResult,
+	databaseErrors map[string][]string,
+	err error,
+) {
+	logger := logger.Logger(ctx).With("cluster", cluster.Name, "namespace", cluster.Namespace)
+	for _, policy := range cluster.Policies {
+		l := logger.With("policy", policy.Name)
+		status := DatabaseAccessPolicyStatus{}
+		for _, database := range policy.Databases() {
+			current := DatabasePolicyStatus{Database: database}
+			for _, s := range policy.Status.Databases {
+				if s.Database == database {
+					current = s
+				}
+			}
+			condition := v1.Condition{
+				Type:               PolicyReadyCondition,
+				Status:             v1.ConditionTrue,
+				Reason:             "Reconciled",
+				Message:            "database has been reconciled",
+				ObservedGeneration: policy.Generation,
+			}
+			if err != nil {
+				condition.Status = v1.ConditionFalse
+				condition.Reason = "ClusterFailed"
+				condition.Message = err.Error()
+			} else if errs := databaseErrors[database]; len(errs) > 0 {
+				condition.Status = v1.ConditionFalse
+				condition.Reason = "ReconcileFailed"
+				condition.Message = strings.Join(errs, "; ")
+			}
+			meta.SetStatusCondition(&current.Conditions, condition)
+			status.Databases = append(status.Databases, current)
+		}
+
+		patch, err := json.Marshal(map[string]any{"status": status})
+		if err != nil {
+			l.Errorw("could not marshal policy status", "error", err)
+			continue
+		}
+		if _, err := client.Resource(PolicyResource).Namespace(policy.Namespace).Patch(
+			ctx,
+			policy.Name,
+			types.MergePatchType,
+			patch,
+			v1.PatchOptions{},
+			"status",
+		); err != nil {
+			l.Errorw("could not update policy status", "error", err)
+		}
+	}
+}
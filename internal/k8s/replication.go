@@ -0,0 +1,96 @@
+package k8s
+
+import (
+	"context"
+
+	crunchy "github.com/crunchydata/postgres-operator/pkg/apis/postgres-operator.crunchydata.com/v1"
+	"go.uber.org/zap"
+	"k8s.io/client-go/dynamic"
+)
+
+// A logical replication publication in a database, either for the
+// listed tables or for all tables
+type Publication struct {
+	Database    string   `json:"database"`
+	Publication string   `json:"publication"`
+	Tables      []string `json:"tables"`
+	AllTables   bool     `json:"allTables"`
+}
+
+// A subscription in a database to publications on another
+// PostgresCluster, connecting as one of that cluster's users
+type Subscription struct {
+	Database     string `json:"database"`
+	Subscription string `json:"subscription"`
+	// The publishing PostgresCluster, in this cluster's namespace
+	// unless one is set
+	Cluster      string   `json:"cluster"`
+	Namespace    string   `json:"namespace"`
+	User         string   `json:"user"`
+	Publications []string `json:"publications"`
+	// The database to subscribe to, defaults to the one in the
+	// user's secret
+	RemoteDatabase string `json:"remoteDatabase"`
+
+	// The publishing user's connection details, read from its secret
+	Credentials ClusterSuperuser `json:"-"`
+}
+
+// Reads the credentials for each subscription from the publishing
+// cluster's secret. Like foreign servers, they aren't cached so
+// rotated passwords are picked up. Subscriptions with a publisher
+// that isn't allowed or with credentials that can't be read are
+// left out.
+func getSubscriptions(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	client *dynamic.DynamicClient,
+	cluster *crunchy.PostgresCluster,
+	declared []Subscription,
+) map[string][]Subscription {
+	out := map[string][]Subscription{}
+	for _, sub := range declared {
+		if sub.Namespace == "" {
+			sub.Namespace = cluster.Namespace
+		}
+		l := logger.With("subscription", sub.Subscription, "source", sub.Cluster, "source_namespace", sub.Namespace)
+		if err := sourceAllowed(ctx, client, cluster, sub.Namespace, sub.Cluster); err != nil {
+			l.Errorw("skipping subscription as the publishing cluster can't be used", "error", err)
+			continue
+		}
+		creds, err := getUserCredentials(ctx, client, sub.Namespace, sub.Cluster, sub.User)
+		if err != nil {
+			l.Errorw("could not get subscription credentials", "error", err)
+			continue
+		}
+		sub.Credentials = creds
+		if sub.RemoteDatabase == "" {
+			sub.RemoteDatabase = creds.Database
+		}
+		out[sub.Database] = append(out[sub.Database], sub)
+	}
+	return out
+}
+
+// A change data capture setup in a database for a consumer such as
+// debezium: a replication user that can read the published tables,
+// the publication and a logical replication slot
+type CDC struct {
+	Database    string   `json:"database"`
+	User        string   `json:"user"`
+	Publication string   `json:"publication"`
+	Tables      []string `json:"tables"`
+	Slot        string   `json:"slot"`
+	// The logical decoding plugin, defaults to pgoutput
+	Plugin string `json:"plugin"`
+	// The slot's lag is only reported as growing once it is over
+	// this many bytes
+	LagThresholdBytes int64 `json:"lagThresholdBytes"`
+}
+
+func (c CDC) SlotPlugin() string {
+	if c.Plugin == "" {
+		return "pgoutput"
+	}
+	return c.Plugin
+}
@@ -0,0 +1,123 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	crunchy "github.com/crunchydata/postgres-operator/pkg/apis/postgres-operator.crunchydata.com/v1"
+	"github.com/henrywhitaker3/crunchy-users/internal/logger"
+	"k8s.io/apimachinery/pkg/api/equality"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	// Only this many errors are kept for each user, database and
+	// extension, so the annotation stays small
+	maxStatusErrors = 10
+)
+
+// The outcome of the last time a cluster was processed, which is
+// written to its status annotation
+type ClusterStatus struct {
+	LastReconcileTime  string `json:"lastReconcileTime"`
+	ObservedGeneration int64  `json:"observedGeneration"`
+	Healthy            bool   `json:"healthy"`
+	// The number of each kind of object that was processed
+	Counts map[string]int `json:"counts"`
+	// The number of changes that were applied
+	Changes int                 `json:"changes"`
+	Errors  ClusterStatusErrors `json:"errors"`
+}
+
+type ClusterStatusErrors struct {
+	// Errors that weren't for a database
+	Cluster    []string            `json:"cluster,omitempty"`
+	Users      map[string][]string `json:"users,omitempty"`
+	Databases  map[string][]string `json:"databases,omitempty"`
+	Extensions map[string][]string `json:"extensions,omitempty"`
+}
+
+func NewClusterStatus(
+	cluster ClusterResult,
+	counts map[string]int,
+	changes int,
+	errors ClusterStatusErrors,
+) ClusterStatus {
+	errors.Cluster = limitErrors(errors.Cluster)
+	for _, m := range []map[string][]string{errors.Users, errors.Databases, errors.Extensions} {
+		for key := range m {
+			m[key] = limitErrors(m[key])
+		}
+	}
+	return ClusterStatus{
+		LastReconcileTime:  time.Now().UTC().Format(time.RFC3339),
+		ObservedGeneration: cluster.Generation,
+		Healthy:            len(errors.Cluster) == 0 && len(errors.Users) == 0 && len(errors.Databases) == 0 && len(errors.Extensions) == 0,
+		Counts:             counts,
+		Changes:            changes,
+		Errors:             errors,
+	}
+}
+
+// Writes the status to the cluster's status annotation
+func ReportClusterStatus(
+	ctx context.Context,
+	client *dynamic.DynamicClient,
+	cluster ClusterResult,
+	status ClusterStatus,
+) {
+	l := logger.Logger(ctx).With("cluster", cluster.Name, "namespace", cluster.Namespace)
+	raw, err := json.Marshal(status)
+	if err != nil {
+		l.Errorw("could not marshal cluster status", "error", err)
+		return
+	}
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				StatusAnnotation: string(raw),
+			},
+		},
+	})
+	if err != nil {
+		l.Errorw("could not marshal cluster status", "error", err)
+		return
+	}
+	if _, err := client.Resource(crunchy.GroupVersion.WithResource("postgresclusters")).Namespace(cluster.Namespace).Patch(
+		ctx,
+		cluster.Name,
+		types.MergePatchType,
+		patch,
+		v1.PatchOptions{},
+	); err != nil {
+		l.Errorw("could not update cluster status", "error", err)
+	}
+}
+
+// Whether the only change between the two versions of the cluster is
+// to its status annotation, which would otherwise cause the cluster
+// to be processed again every time its status is written
+func onlyStatusChanged(old, new *unstructured.Unstructured) bool {
+	strip := func(u *unstructured.Unstructured) *unstructured.Unstructured {
+		u = u.DeepCopy()
+		annotations := u.GetAnnotations()
+		delete(annotations, StatusAnnotation)
+		u.SetAnnotations(annotations)
+		u.SetResourceVersion("")
+		u.SetManagedFields(nil)
+		return u
+	}
+	return old.GetAnnotations()[StatusAnnotation] != new.GetAnnotations()[StatusAnnotation] &&
+		equality.Semantic.DeepEqual(strip(old).Object, strip(new).Object)
+}
+
+func limitErrors(errs []string) []string {
+	if len(errs) > maxStatusErrors {
+		return errs[:maxStatusErrors]
+	}
+	return errs
+}
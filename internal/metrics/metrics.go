@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "crunchy_users"
+)
+
+var (
+	Reconciles = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconciles_total",
+		Help:      "The number of times each cluster has been processed, by whether it succeeded",
+	}, []string{"cluster", "namespace", "result"})
+	ReconcileDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "reconcile_duration_seconds",
+		Help:      "How long it took to process each cluster",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"cluster", "namespace"})
+	SQLErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sql_errors_total",
+		Help:      "The number of queries that failed, by the operation that ran them",
+	}, []string{"operation"})
+	DDLStatements = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ddl_statements_total",
+		Help:      "The number of DDL statements executed, by the operation that ran them",
+	}, []string{"operation"})
+	WatchedClusters = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "watched_clusters",
+		Help:      "The number of clusters with the watch label",
+	})
+)
+
+// Records a cluster being processed
+func ObserveReconcile(cluster, ns string, duration time.Duration, failed bool) {
+	result := "success"
+	if failed {
+		result = "failure"
+	}
+	Reconciles.WithLabelValues(cluster, ns, result).Inc()
+	ReconcileDuration.WithLabelValues(cluster, ns).Observe(duration.Seconds())
+}
+
+// Reports the number of connections open to the clusters' databases,
+// which count returns when the metrics are collected
+func OpenConnections(count func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "open_connections",
+		Help:      "The number of connections open to the clusters' databases",
+	}, func() float64 {
+		return float64(count())
+	})
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
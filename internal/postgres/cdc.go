@@ -0,0 +1,173 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
+	"github.com/henrywhitaker3/flow"
+	"go.uber.org/zap"
+)
+
+var (
+	// The lag of each replication slot the last time its cluster
+	// was processed, used to tell when it is growing
+	slotLag = flow.NewStore[int64]()
+)
+
+// A replication slot as it is in pg_replication_slots
+type ReplicationSlot struct {
+	Plugin string
+	Active bool
+	// How far behind the current WAL position the consumer has
+	// confirmed it has got to
+	LagBytes int64
+}
+
+func (p *processor) ReplicationSlot(ctx context.Context, db *sql.DB, slot string) (ReplicationSlot, bool, error) {
+	row := db.QueryRowContext(
+		ctx,
+		`SELECT COALESCE(plugin, ''), active,
+			COALESCE(pg_wal_lsn_diff(pg_current_wal_lsn(), confirmed_flush_lsn), 0)::bigint
+		FROM pg_catalog.pg_replication_slots
+		WHERE slot_name = $1`,
+		slot,
+	)
+	var out ReplicationSlot
+	if err := row.Scan(&out.Plugin, &out.Active, &out.LagBytes); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return out, false, nil
+		}
+		return out, false, err
+	}
+	return out, true, nil
+}
+
+func (p *processor) CreateReplicationSlot(ctx context.Context, db *sql.DB, slot, plugin string) error {
+	_, err := db.ExecContext(ctx, "SELECT pg_create_logical_replication_slot($1, $2)", slot, plugin)
+	return err
+}
+
+func (p *processor) TablesWithoutSelect(ctx context.Context, db *sql.DB, user string, tables []string) ([]string, error) {
+	out := []string{}
+	for _, table := range tables {
+		schema, name, _ := strings.Cut(table, ".")
+		row := db.QueryRowContext(
+			ctx,
+			"SELECT has_table_privilege($1, format('%I.%I', $2::text, $3::text), 'SELECT')",
+			user,
+			schema,
+			name,
+		)
+		var ok bool
+		if err := row.Scan(&ok); err != nil {
+			return nil, err
+		}
+		if !ok {
+			out = append(out, table)
+		}
+	}
+	return out, nil
+}
+
+func (p *processor) GrantSelect(ctx context.Context, db *sql.DB, user string, tables []string) error {
+	schemas := []string{}
+	for _, table := range tables {
+		schema, _, _ := strings.Cut(table, ".")
+		if !slices.Contains(schemas, schema) {
+			schemas = append(schemas, schema)
+		}
+	}
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"GRANT USAGE ON SCHEMA %s TO \"%s\"; GRANT SELECT ON TABLE %s TO \"%s\"",
+		quoteIdentifiers(schemas),
+		user,
+		quoteTables(tables),
+		user,
+	))
+	return err
+}
+
+// Sets up the user, publication and replication slot a change data
+// capture consumer needs, and reports when the slot's lag is growing
+func handleCDC(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	cluster k8s.ClusterResult,
+	cdc k8s.CDC,
+) {
+	l := logger.With("database", cdc.Database, "user", cdc.User, "slot", cdc.Slot)
+	l.Debug("processing cdc")
+
+	if exists, err := processor.DatabaseExists(ctx, db, cluster.Key(), cdc.Database); err != nil {
+		l.Errorw("could not determine if database exists", "error", err)
+		return
+	} else if !exists {
+		l.Debug("database does not exist, skipping")
+		return
+	}
+	if exists, err := processor.UserExists(ctx, db, cdc.User); err != nil {
+		l.Errorw("could not determine is user exists", "error", err)
+		return
+	} else if !exists {
+		l.Debug("user does not exist, skipping")
+		return
+	}
+
+	replication := true
+	handleRoleAttributes(ctx, l, processor, db, k8s.RoleAttributes{User: cdc.User, Replication: &replication})
+
+	publication := k8s.Publication{
+		Database:    cdc.Database,
+		Publication: cdc.Publication,
+		Tables:      cdc.Tables,
+	}
+	handlePublication(ctx, l, processor, db, cluster, publication)
+
+	ddb, err := getDatabaseDb(ctx, cluster, cdc.Database)
+	if err != nil {
+		l.Errorw("could not connect to database", "error", err)
+		return
+	}
+	if missing, err := processor.TablesWithoutSelect(ctx, ddb, cdc.User, publicationTables(publication)); err != nil {
+		l.Errorw("could not determine table privileges", "error", err)
+	} else if len(missing) > 0 {
+		if err := processor.GrantSelect(ctx, ddb, cdc.User, missing); err != nil {
+			l.Errorw("could not grant select on published tables", "error", err)
+		} else {
+			changed(l, "granted select on published tables", "tables", missing)
+		}
+	}
+
+	slot, exists, err := processor.ReplicationSlot(ctx, ddb, cdc.Slot)
+	if err != nil {
+		l.Errorw("could not get replication slot", "error", err)
+		return
+	}
+	if !exists {
+		if err := processor.CreateReplicationSlot(ctx, ddb, cdc.Slot, cdc.SlotPlugin()); err != nil {
+			l.Errorw("could not create replication slot", "error", err)
+		} else {
+			changed(l, "created replication slot", "plugin", cdc.SlotPlugin())
+		}
+		return
+	}
+	if slot.Plugin != cdc.SlotPlugin() {
+		l.Errorw("replication slot has to be recreated to change its plugin", "plugin", slot.Plugin, "desired", cdc.SlotPlugin())
+	}
+
+	key := fmt.Sprintf("%s:%s", cluster.Key(), cdc.Slot)
+	previous, ok := slotLag.Get(key)
+	slotLag.Put(key, slot.LagBytes)
+	if ok && slot.LagBytes > previous && slot.LagBytes > cdc.LagThresholdBytes {
+		// Logged as an error so it is reported on the cluster's status
+		// and as a Warning event, not only in the operator's logs
+		l.Errorw("replication slot lag is growing", "lag_bytes", slot.LagBytes, "previous_lag_bytes", previous, "active", slot.Active)
+	}
+}
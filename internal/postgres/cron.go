@@ -0,0 +1,203 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+
+	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
+	"go.uber.org/zap"
+)
+
+// A named job in cron.job
+type ScheduledJob struct {
+	ID       int64
+	Name     string
+	Schedule string
+	Database string
+	Command  string
+	Owner    string
+}
+
+// Jobs scheduled by crunchy-users are recorded in this table in the
+// superuser's database, so only those are ever unscheduled
+const cronJobsTable = `CREATE SCHEMA IF NOT EXISTS crunchy_users;
+CREATE TABLE IF NOT EXISTS crunchy_users.cron_jobs (
+	name text PRIMARY KEY,
+	scheduled_at timestamptz NOT NULL DEFAULT now()
+);`
+
+func (p *processor) CronJobs(ctx context.Context, db *sql.DB) ([]ScheduledJob, error) {
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT jobid, jobname, schedule, database, command, username
+		FROM cron.job
+		WHERE jobname IS NOT NULL
+		ORDER BY jobid`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []ScheduledJob{}
+	for rows.Next() {
+		var job ScheduledJob
+		if err := rows.Scan(&job.ID, &job.Name, &job.Schedule, &job.Database, &job.Command, &job.Owner); err != nil {
+			return nil, err
+		}
+		out = append(out, job)
+	}
+	return out, rows.Err()
+}
+
+func (p *processor) ScheduleCronJob(ctx context.Context, db *sql.DB, job k8s.CronJob) error {
+	_, err := db.ExecContext(
+		ctx,
+		"SELECT cron.schedule_in_database($1, $2, $3, $4, $5)",
+		job.Name,
+		job.Schedule,
+		job.Command,
+		job.Database,
+		job.Owner,
+	)
+	return err
+}
+
+func (p *processor) UnscheduleCronJob(ctx context.Context, db *sql.DB, id int64) error {
+	_, err := db.ExecContext(ctx, "SELECT cron.unschedule($1::bigint)", id)
+	return err
+}
+
+func (p *processor) RecordCronJob(ctx context.Context, db *sql.DB, name string) error {
+	if _, err := db.ExecContext(ctx, cronJobsTable); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, "INSERT INTO crunchy_users.cron_jobs (name) VALUES ($1) ON CONFLICT DO NOTHING", name)
+	return err
+}
+
+func (p *processor) ForgetCronJob(ctx context.Context, db *sql.DB, name string) error {
+	if _, err := db.ExecContext(ctx, cronJobsTable); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, "DELETE FROM crunchy_users.cron_jobs WHERE name = $1", name)
+	return err
+}
+
+func (p *processor) ManagedCronJobs(ctx context.Context, db *sql.DB) ([]string, error) {
+	if _, err := db.ExecContext(ctx, cronJobsTable); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT name FROM crunchy_users.cron_jobs ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		out = append(out, name)
+	}
+	return out, rows.Err()
+}
+
+// Schedules the declared pg_cron jobs, rescheduling any that have
+// drifted, and unschedules the jobs crunchy-users scheduled that are
+// no longer declared. Jobs scheduled by hand are left alone.
+func handleCronJobs(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	cluster k8s.ClusterResult,
+) {
+	logger.Debug("processing cron jobs")
+	if exists, err := processor.ExtensionExists(ctx, db, "pg_cron"); err != nil {
+		logger.Errorw("could not determine if pg_cron is installed", "error", err)
+		return
+	} else if !exists {
+		logger.Errorw("skipping cron jobs as pg_cron is not installed", "database", cluster.Superuser.Database)
+		return
+	}
+
+	current, err := processor.CronJobs(ctx, db)
+	if err != nil {
+		logger.Errorw("could not get cron jobs", "error", err)
+		return
+	}
+
+	declared := []string{}
+	for _, job := range cluster.CronJobs {
+		declared = append(declared, job.Name)
+		l := logger.With("job", job.Name)
+		if job.Owner == "" {
+			job.Owner = cluster.Superuser.User
+		}
+
+		upToDate := false
+		for _, c := range current {
+			if c.Name != job.Name {
+				continue
+			}
+			if c.Owner != job.Owner {
+				// Jobs are unique by name per owner, so the old owner's
+				// job would be left behind when it is rescheduled
+				if err := processor.UnscheduleCronJob(ctx, db, c.ID); err != nil {
+					l.Errorw("could not unschedule cron job", "error", err)
+				} else {
+					changed(l, "unscheduled job with previous owner", "owner", c.Owner)
+				}
+				continue
+			}
+			upToDate = c.Schedule == job.Schedule && c.Database == job.Database && c.Command == job.Command
+		}
+		if upToDate {
+			l.Debug("cron job is up to date")
+			continue
+		}
+
+		if err := processor.ScheduleCronJob(ctx, db, job); err != nil {
+			l.Errorw("could not schedule cron job", "error", err)
+			continue
+		}
+		changed(l, "scheduled cron job", "schedule", job.Schedule)
+		if err := processor.RecordCronJob(ctx, db, job.Name); err != nil {
+			l.Errorw("could not record scheduled cron job", "error", err)
+		}
+	}
+
+	managed, err := processor.ManagedCronJobs(ctx, db)
+	if err != nil {
+		logger.Errorw("could not get scheduled cron jobs", "error", err)
+		return
+	}
+	for _, name := range managed {
+		if slices.Contains(declared, name) {
+			continue
+		}
+		l := logger.With("job", name)
+		failed := false
+		for _, c := range current {
+			if c.Name != name {
+				continue
+			}
+			if err := processor.UnscheduleCronJob(ctx, db, c.ID); err != nil {
+				l.Errorw("could not unschedule cron job", "error", err)
+				failed = true
+			} else {
+				changed(l, "unscheduled cron job")
+			}
+		}
+		if failed {
+			continue
+		}
+		if err := processor.ForgetCronJob(ctx, db, name); err != nil {
+			l.Errorw("could not forget unscheduled cron job", "error", err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
+	"go.uber.org/zap"
+)
+
+func (p *processor) CreateDatabase(ctx context.Context, db *sql.DB, spec k8s.DatabaseSpec) error {
+	_, err := db.ExecContext(ctx, createDatabaseQuery(spec))
+	return err
+}
+
+// The CREATE DATABASE statement for the spec. template1 can only be
+// copied with its own encoding and locale, so template0 is used
+// when they are set and no template is given.
+func createDatabaseQuery(spec k8s.DatabaseSpec) string {
+	query := fmt.Sprintf("CREATE DATABASE \"%s\"", spec.Database)
+	if spec.Owner != "" {
+		query = fmt.Sprintf("%s OWNER \"%s\"", query, spec.Owner)
+	}
+	template := spec.Template
+	if template == "" && (spec.Encoding != "" || spec.LcCollate != "" || spec.LcCtype != "" || spec.IcuLocale != "") {
+		template = "template0"
+	}
+	if template != "" {
+		query = fmt.Sprintf("%s TEMPLATE \"%s\"", query, template)
+	}
+	if spec.Encoding != "" {
+		query = fmt.Sprintf("%s ENCODING '%s'", query, spec.Encoding)
+	}
+	if spec.LcCollate != "" {
+		query = fmt.Sprintf("%s LC_COLLATE '%s'", query, spec.LcCollate)
+	}
+	if spec.LcCtype != "" {
+		query = fmt.Sprintf("%s LC_CTYPE '%s'", query, spec.LcCtype)
+	}
+	if spec.IcuLocale != "" {
+		query = fmt.Sprintf("%s LOCALE_PROVIDER icu ICU_LOCALE '%s'", query, spec.IcuLocale)
+	}
+	return query
+}
+
+func (p *processor) DatabaseOptions(ctx context.Context, db *sql.DB, database string) (k8s.DatabaseSpec, error) {
+	// The ICU locale column was renamed to datlocale in 17, so
+	// go through jsonb to support both
+	row := db.QueryRowContext(
+		ctx,
+		`SELECT pg_encoding_to_char(d.encoding), d.datcollate, d.datctype,
+			COALESCE(to_jsonb(d)->>'datlocale', to_jsonb(d)->>'daticulocale', '')
+		FROM pg_catalog.pg_database d
+		WHERE d.datname = $1 LIMIT 1`,
+		database,
+	)
+	out := k8s.DatabaseSpec{Database: database}
+	if err := row.Scan(&out.Encoding, &out.LcCollate, &out.LcCtype, &out.IcuLocale); err != nil {
+		return out, err
+	}
+	return out, nil
+}
+
+// Creates the database when it doesn't exist, otherwise reports
+// any options that don't match as they can't be changed
+func handleDatabase(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	cluster k8s.ClusterResult,
+	spec k8s.DatabaseSpec,
+) {
+	l := logger.With("database", spec.Database)
+	l.Debug("processing database")
+
+	if exists, err := processor.DatabaseExists(ctx, db, cluster.Key(), spec.Database); err != nil {
+		l.Errorw("could not determine if database exists", "error", err)
+		return
+	} else if !exists {
+		if err := processor.CreateDatabase(ctx, db, spec); err != nil {
+			l.Errorw("could not create database", "error", err)
+		} else {
+			changed(l, "created database")
+		}
+		return
+	}
+
+	current, err := processor.DatabaseOptions(ctx, db, spec.Database)
+	if err != nil {
+		l.Errorw("could not get database options", "error", err)
+		return
+	}
+	for _, option := range []struct {
+		name    string
+		desired string
+		current string
+	}{
+		{name: "encoding", desired: spec.Encoding, current: current.Encoding},
+		{name: "lcCollate", desired: spec.LcCollate, current: current.LcCollate},
+		{name: "lcCtype", desired: spec.LcCtype, current: current.LcCtype},
+		{name: "icuLocale", desired: spec.IcuLocale, current: current.IcuLocale},
+	} {
+		if option.desired != "" && !strings.EqualFold(normaliseLocale(option.desired), normaliseLocale(option.current)) {
+			l.Errorw(
+				"database option does not match and cannot be changed",
+				"option", option.name,
+				"desired", option.desired,
+				"current", option.current,
+			)
+		}
+	}
+}
+
+// Treats en_US.UTF-8 and en_US.utf8 as the same locale
+func normaliseLocale(locale string) string {
+	return strings.ReplaceAll(locale, "-", "")
+}
@@ -0,0 +1,234 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
+	"go.uber.org/zap"
+)
+
+// Extensions installed by crunchy-users are recorded in this table
+// in the superuser's database, so only those are ever pruned
+const extensionsTable = `CREATE SCHEMA IF NOT EXISTS crunchy_users;
+CREATE TABLE IF NOT EXISTS crunchy_users.extensions (
+	database text NOT NULL,
+	extension text NOT NULL,
+	installed_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (database, extension)
+);`
+
+func (p *processor) RecordExtension(ctx context.Context, db *sql.DB, database, name string) error {
+	if _, err := db.ExecContext(ctx, extensionsTable); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(
+		ctx,
+		"INSERT INTO crunchy_users.extensions (database, extension) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		database,
+		name,
+	)
+	return err
+}
+
+func (p *processor) ForgetExtension(ctx context.Context, db *sql.DB, database, name string) error {
+	if _, err := db.ExecContext(ctx, extensionsTable); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(
+		ctx,
+		"DELETE FROM crunchy_users.extensions WHERE database = $1 AND extension = $2",
+		database,
+		name,
+	)
+	return err
+}
+
+func (p *processor) InstalledExtensions(ctx context.Context, db *sql.DB, database string) ([]string, error) {
+	if _, err := db.ExecContext(ctx, extensionsTable); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(
+		ctx,
+		"SELECT extension FROM crunchy_users.extensions WHERE database = $1 ORDER BY extension",
+		database,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []string{}
+	for rows.Next() {
+		var ext string
+		if err := rows.Scan(&ext); err != nil {
+			return nil, err
+		}
+		out = append(out, ext)
+	}
+	return out, rows.Err()
+}
+
+// Returns the databases crunchy-users has installed extensions in
+func (p *processor) ExtensionDatabases(ctx context.Context, db *sql.DB) ([]string, error) {
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass('crunchy_users.extensions') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return []string{}, nil
+	}
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT database FROM crunchy_users.extensions ORDER BY database")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []string{}
+	for rows.Next() {
+		var database string
+		if err := rows.Scan(&database); err != nil {
+			return nil, err
+		}
+		out = append(out, database)
+	}
+	return out, rows.Err()
+}
+
+func (p *processor) DropExtension(ctx context.Context, db *sql.DB, name string, cascade bool) error {
+	query := fmt.Sprintf("DROP EXTENSION IF EXISTS %s", name)
+	if cascade {
+		query = fmt.Sprintf("%s CASCADE", query)
+	}
+	_, err := db.ExecContext(ctx, query)
+	return err
+}
+
+// An error reconciling a single extension, so it can be reported
+// against the extension as well as the database
+type ExtensionError struct {
+	Extension string
+	Err       error
+}
+
+func (e ExtensionError) Error() string {
+	return fmt.Sprintf("extension %s: %s", e.Extension, e.Err)
+}
+
+func (e ExtensionError) Unwrap() error {
+	return e.Err
+}
+
+// Installs the database's declared extensions, moving and updating
+// the ones already installed, and prunes the ones no longer declared
+// when enabled. The failures for each extension are returned
+// together, so the database has a single outcome.
+func handleExtensions(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	cluster k8s.ClusterResult,
+	database string,
+) error {
+	l := logger.With("database", database)
+	l.Debug("processing extensions")
+
+	if exists, err := processor.DatabaseExists(ctx, db, cluster.Key(), database); err != nil {
+		return fmt.Errorf("could not determine if database exists: %w", err)
+	} else if !exists {
+		l.Debug("database does not exist, skipping")
+		return nil
+	}
+	// Template databases can't be copied while anything is connected
+	// to them, so they aren't kept connected to
+	template, err := processor.IsTemplateDatabase(ctx, db, database)
+	if err != nil {
+		return fmt.Errorf("could not determine if database is a template: %w", err)
+	}
+	var ddb *sql.DB
+	if template {
+		ddb, err = openDatabaseDb(ctx, cluster, database)
+	} else {
+		ddb, err = getDatabaseDb(ctx, cluster, database)
+	}
+	if err != nil {
+		return fmt.Errorf("could not connect to database: %w", err)
+	}
+	if template {
+		defer ddb.Close()
+	}
+
+	errs := []error{}
+	for _, ext := range cluster.Extensions[database] {
+		le := l.With("extension", ext.Extension)
+		le.Debugw("processing extension")
+		exists, err := processor.ExtensionExists(ctx, ddb, ext.Extension)
+		if err != nil {
+			errs = append(errs, ExtensionError{ext.Extension, fmt.Errorf("could not determine if extension exists: %w", err)})
+			continue
+		}
+		if exists {
+			le.Debug("extension already installed")
+			if err := handleExistingExtension(ctx, le, processor, ddb, ext); err != nil {
+				errs = append(errs, ExtensionError{ext.Extension, err})
+			}
+			continue
+		}
+		if err := processor.CreateExtension(ctx, ddb, ext.Extension, ext.Cascade, ext.Version, ext.Schema); err != nil {
+			errs = append(errs, ExtensionError{ext.Extension, fmt.Errorf("could not install extension: %w", err)})
+			continue
+		}
+		changed(le, "created extension")
+		if err := processor.RecordExtension(ctx, db, database, ext.Extension); err != nil {
+			errs = append(errs, ExtensionError{ext.Extension, fmt.Errorf("could not record installed extension: %w", err)})
+		}
+	}
+
+	if cluster.PruneExtensions {
+		handlePruneExtensions(ctx, l, processor, db, ddb, cluster, database)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Drops the extensions crunchy-users installed in the database
+// that are no longer in the extensions annotation
+func handlePruneExtensions(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	ddb *sql.DB,
+	cluster k8s.ClusterResult,
+	database string,
+) {
+	installed, err := processor.InstalledExtensions(ctx, db, database)
+	if err != nil {
+		logger.Errorw("could not get installed extensions", "error", err)
+		return
+	}
+
+	declared := []string{}
+	for _, ext := range cluster.Extensions[database] {
+		declared = append(declared, ext.Extension)
+	}
+
+	for _, ext := range installed {
+		if slices.Contains(declared, ext) {
+			continue
+		}
+		l := logger.With("extension", ext, "cascade", cluster.PruneExtensionsCascade)
+		if err := processor.DropExtension(ctx, ddb, ext, cluster.PruneExtensionsCascade); err != nil {
+			l.Errorw("could not drop extension", "error", err)
+			continue
+		}
+		changed(l, "dropped extension")
+		if err := processor.ForgetExtension(ctx, db, database, ext); err != nil {
+			l.Errorw("could not forget dropped extension", "error", err)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
+	"go.uber.org/zap"
+)
+
+func (p *processor) ForeignServerOptions(ctx context.Context, db *sql.DB, server string) (map[string]string, bool, error) {
+	row := db.QueryRowContext(
+		ctx,
+		"SELECT COALESCE(array_to_json(srvoptions)::text, '[]') FROM pg_catalog.pg_foreign_server WHERE srvname = $1",
+		server,
+	)
+	return scanOptions(row)
+}
+
+func (p *processor) CreateForeignServer(ctx context.Context, db *sql.DB, server string, options map[string]string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE SERVER \"%s\" FOREIGN DATA WRAPPER postgres_fdw OPTIONS (%s)",
+		server,
+		strings.Join(fdwOptions(options, nil), ", "),
+	))
+	return err
+}
+
+func (p *processor) AlterForeignServer(ctx context.Context, db *sql.DB, server string, options []string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER SERVER \"%s\" OPTIONS (%s)", server, strings.Join(options, ", ")))
+	return err
+}
+
+func (p *processor) UserMappingOptions(ctx context.Context, db *sql.DB, server, user string) (map[string]string, bool, error) {
+	row := db.QueryRowContext(
+		ctx,
+		`SELECT COALESCE(array_to_json(umoptions)::text, '[]')
+		FROM pg_catalog.pg_user_mappings
+		WHERE srvname = $1 AND usename = $2`,
+		server,
+		mappingUser(user),
+	)
+	return scanOptions(row)
+}
+
+func (p *processor) CreateUserMapping(ctx context.Context, db *sql.DB, server, user string, options map[string]string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE USER MAPPING FOR %s SERVER \"%s\" OPTIONS (%s)",
+		mappingRole(user),
+		server,
+		strings.Join(fdwOptions(options, nil), ", "),
+	))
+	return err
+}
+
+func (p *processor) AlterUserMapping(ctx context.Context, db *sql.DB, server, user string, options []string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"ALTER USER MAPPING FOR %s SERVER \"%s\" OPTIONS (%s)",
+		mappingRole(user),
+		server,
+		strings.Join(options, ", "),
+	))
+	return err
+}
+
+func (p *processor) HasForeignTables(ctx context.Context, db *sql.DB, server, schema string) (bool, error) {
+	row := db.QueryRowContext(
+		ctx,
+		`SELECT EXISTS (
+			SELECT 1
+			FROM pg_catalog.pg_foreign_table t
+			JOIN pg_catalog.pg_foreign_server s ON s.oid = t.ftserver
+			JOIN pg_catalog.pg_class c ON c.oid = t.ftrelid
+			JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+			WHERE s.srvname = $1 AND n.nspname = $2
+		)`,
+		server,
+		schema,
+	)
+	var exists bool
+	if err := row.Scan(&exists); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func (p *processor) ImportForeignSchema(ctx context.Context, db *sql.DB, server, remote, local string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"IMPORT FOREIGN SCHEMA \"%s\" FROM SERVER \"%s\" INTO \"%s\"",
+		remote,
+		server,
+		local,
+	))
+	return err
+}
+
+// Creates the foreign server and user mapping pointing at the source
+// cluster, updating them when the source's connection details or
+// password change, and imports the remote schema when it hasn't
+// been already
+func handleForeignServer(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	cluster k8s.ClusterResult,
+	server k8s.ForeignServer,
+) {
+	l := logger.With("database", server.Database, "server", server.Server)
+	l.Debug("processing foreign server")
+
+	if exists, err := processor.DatabaseExists(ctx, db, cluster.Key(), server.Database); err != nil {
+		l.Errorw("could not determine if database exists", "error", err)
+		return
+	} else if !exists {
+		l.Debug("database does not exist, skipping")
+		return
+	}
+
+	ddb, err := getDatabaseDb(ctx, cluster, server.Database)
+	if err != nil {
+		l.Errorw("could not connect to database", "error", err)
+		return
+	}
+	if exists, err := processor.ExtensionExists(ctx, ddb, "postgres_fdw"); err != nil {
+		l.Errorw("could not determine if postgres_fdw is installed", "error", err)
+		return
+	} else if !exists {
+		l.Errorw("skipping foreign server as postgres_fdw is not installed")
+		return
+	}
+
+	serverOptions := map[string]string{
+		"host":   server.Credentials.Host,
+		"port":   strconv.Itoa(server.Credentials.Port),
+		"dbname": server.RemoteDatabase,
+	}
+	current, exists, err := processor.ForeignServerOptions(ctx, ddb, server.Server)
+	if err != nil {
+		l.Errorw("could not get foreign server options", "error", err)
+		return
+	}
+	if !exists {
+		if err := processor.CreateForeignServer(ctx, ddb, server.Server, serverOptions); err != nil {
+			l.Errorw("could not create foreign server", "error", err)
+			return
+		}
+		changed(l, "created foreign server")
+	} else if options := fdwOptions(serverOptions, current); len(options) > 0 {
+		if err := processor.AlterForeignServer(ctx, ddb, server.Server, options); err != nil {
+			l.Errorw("could not update foreign server options", "error", err)
+		} else {
+			changed(l, "updated foreign server options")
+		}
+	}
+
+	lu := l.With("local_user", mappingUser(server.LocalUser))
+	mappingOptions := map[string]string{
+		"user":     server.Credentials.User,
+		"password": server.Credentials.Password,
+	}
+	current, exists, err = processor.UserMappingOptions(ctx, ddb, server.Server, server.LocalUser)
+	if err != nil {
+		lu.Errorw("could not get user mapping options", "error", err)
+		return
+	}
+	if !exists {
+		if err := processor.CreateUserMapping(ctx, ddb, server.Server, server.LocalUser, mappingOptions); err != nil {
+			lu.Errorw("could not create user mapping", "error", err)
+			return
+		}
+		changed(lu, "created user mapping")
+	} else if options := fdwOptions(mappingOptions, current); len(options) > 0 {
+		// The options include the password, so they aren't logged
+		if err := processor.AlterUserMapping(ctx, ddb, server.Server, server.LocalUser, options); err != nil {
+			lu.Errorw("could not update user mapping", "error", err)
+		} else {
+			changed(lu, "updated user mapping")
+		}
+	}
+
+	if server.ImportSchema == "" {
+		return
+	}
+	into := server.IntoSchema
+	if into == "" {
+		into = server.ImportSchema
+	}
+	ls := l.With("schema", server.ImportSchema, "into", into)
+	if imported, err := processor.HasForeignTables(ctx, ddb, server.Server, into); err != nil {
+		ls.Errorw("could not determine if foreign schema has been imported", "error", err)
+		return
+	} else if imported {
+		ls.Debug("foreign schema already imported")
+		return
+	}
+	if err := processor.CreateSchema(ctx, ddb, into, ""); err != nil {
+		ls.Errorw("could not create schema", "error", err)
+		return
+	}
+	if err := processor.ImportForeignSchema(ctx, ddb, server.Server, server.ImportSchema, into); err != nil {
+		ls.Errorw("could not import foreign schema", "error", err)
+	} else {
+		changed(ls, "imported foreign schema")
+	}
+}
+
+// Builds the OPTIONS needed to get from the current options to the
+// desired ones, adding the ones that are missing and setting the ones
+// that have changed. With no current options, they are the options
+// to create the object with.
+func fdwOptions(desired, current map[string]string) []string {
+	out := []string{}
+	for _, name := range sortedKeys(desired) {
+		value, ok := current[name]
+		literal := quoteLiteral(desired[name])
+		if current == nil {
+			out = append(out, fmt.Sprintf("%s %s", name, literal))
+		} else if !ok {
+			out = append(out, fmt.Sprintf("ADD %s %s", name, literal))
+		} else if value != desired[name] {
+			out = append(out, fmt.Sprintf("SET %s %s", name, literal))
+		}
+	}
+	return out
+}
+
+func scanOptions(row *sql.Row) (map[string]string, bool, error) {
+	var raw string
+	if err := row.Scan(&raw); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	options := []string{}
+	if err := json.Unmarshal([]byte(raw), &options); err != nil {
+		return nil, false, err
+	}
+	out := map[string]string{}
+	for _, option := range options {
+		name, value, _ := strings.Cut(option, "=")
+		out[name] = value
+	}
+	return out, true, nil
+}
+
+// The role a user mapping is for, as it is in pg_user_mappings
+func mappingUser(user string) string {
+	if strings.EqualFold(user, "public") {
+		return "public"
+	}
+	return user
+}
+
+func mappingRole(user string) string {
+	if strings.EqualFold(user, "public") {
+		return "PUBLIC"
+	}
+	return fmt.Sprintf("\"%s\"", user)
+}
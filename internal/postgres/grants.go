@@ -0,0 +1,393 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
+	"go.uber.org/zap"
+)
+
+const (
+	GrantDatabase  = "DATABASE"
+	GrantSchema    = "SCHEMA"
+	GrantTables    = "TABLES"
+	GrantSequences = "SEQUENCES"
+)
+
+// Tracks the grants crunchy-users has applied, and the schemas
+// they were for, so they can be revoked once they are removed from
+// the annotation
+const grantsTable = `CREATE SCHEMA IF NOT EXISTS crunchy_users;
+CREATE TABLE IF NOT EXISTS crunchy_users.grants (
+	database text NOT NULL,
+	"user" text NOT NULL,
+	schemas jsonb NOT NULL,
+	granted_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (database, "user")
+);`
+
+var (
+	// The privileges each grant level is made up of, for each
+	// type of object. A level of none revokes everything
+	grantLevels = map[string]map[string][]string{
+		"none": {},
+		"connect": {
+			GrantDatabase: {"CONNECT"},
+		},
+		"read": {
+			GrantDatabase:  {"CONNECT"},
+			GrantSchema:    {"USAGE"},
+			GrantTables:    {"SELECT"},
+			GrantSequences: {"SELECT"},
+		},
+		"readwrite": {
+			GrantDatabase:  {"CONNECT"},
+			GrantSchema:    {"USAGE"},
+			GrantTables:    {"SELECT", "INSERT", "UPDATE", "DELETE"},
+			GrantSequences: {"SELECT", "USAGE", "UPDATE"},
+		},
+		"all": {
+			GrantDatabase:  {"CONNECT", "CREATE", "TEMPORARY"},
+			GrantSchema:    {"USAGE", "CREATE"},
+			GrantTables:    {"SELECT", "INSERT", "UPDATE", "DELETE", "TRUNCATE", "REFERENCES", "TRIGGER"},
+			GrantSequences: {"SELECT", "USAGE", "UPDATE"},
+		},
+	}
+)
+
+// Identifies the objects of a single type that a user is
+// granted privileges on. Schema is not used for databases.
+type GrantTarget struct {
+	User     string
+	Database string
+	Schema   string
+	// One of DATABASE, SCHEMA, TABLES or SEQUENCES
+	Objects string
+}
+
+// The privileges a user currently holds on the objects of a
+// GrantTarget. All contains privileges held on every object,
+// and Any privileges held on at least one of them.
+type Privileges struct {
+	All []string
+	Any []string
+	// There are no tables or sequences the user doesn't own in
+	// the schema, so there is nothing to grant or revoke
+	Empty bool
+}
+
+func (p *processor) Privileges(ctx context.Context, db *sql.DB, target GrantTarget) (Privileges, error) {
+	var query string
+	var args []any
+	switch target.Objects {
+	case GrantDatabase:
+		query = `SELECT acl.privilege_type, true
+			FROM pg_catalog.pg_database d
+			CROSS JOIN LATERAL aclexplode(d.datacl) acl
+			JOIN pg_catalog.pg_roles r ON r.oid = acl.grantee
+			WHERE d.datname = $1 AND r.rolname = $2 AND d.datdba <> r.oid`
+		args = []any{target.Database, target.User}
+	case GrantSchema:
+		query = `SELECT acl.privilege_type, true
+			FROM pg_catalog.pg_namespace n
+			CROSS JOIN LATERAL aclexplode(n.nspacl) acl
+			JOIN pg_catalog.pg_roles r ON r.oid = acl.grantee
+			WHERE n.nspname = $1 AND r.rolname = $2 AND n.nspowner <> r.oid`
+		args = []any{target.Schema, target.User}
+	case GrantTables, GrantSequences:
+		kinds := "'r', 'p', 'v', 'm', 'f'"
+		if target.Objects == GrantSequences {
+			kinds = "'S'"
+		}
+		// Objects the user owns are left out, as owners already
+		// have every privilege on them
+		objects := fmt.Sprintf(`SELECT c.oid, c.relacl
+			FROM pg_catalog.pg_class c
+			JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+			WHERE n.nspname = $1 AND c.relkind IN (%s)
+			AND c.relowner <> (SELECT oid FROM pg_catalog.pg_roles WHERE rolname = $2)`, kinds)
+		args = []any{target.Schema, target.User}
+
+		var count int
+		if err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT count(*) FROM (%s) objects", objects), args...).Scan(&count); err != nil {
+			return Privileges{}, err
+		}
+		if count == 0 {
+			return Privileges{All: []string{}, Any: []string{}, Empty: true}, nil
+		}
+		query = fmt.Sprintf(`WITH objects AS (%s)
+			SELECT acl.privilege_type, count(DISTINCT o.oid) = (SELECT count(*) FROM objects)
+			FROM objects o
+			CROSS JOIN LATERAL aclexplode(o.relacl) acl
+			JOIN pg_catalog.pg_roles r ON r.oid = acl.grantee
+			WHERE r.rolname = $2
+			GROUP BY acl.privilege_type`, objects)
+	default:
+		return Privileges{}, fmt.Errorf("unknown grant object type %s", target.Objects)
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return Privileges{}, err
+	}
+	defer rows.Close()
+
+	out := Privileges{All: []string{}, Any: []string{}}
+	for rows.Next() {
+		var privilege string
+		var all bool
+		if err := rows.Scan(&privilege, &all); err != nil {
+			return Privileges{}, err
+		}
+		out.Any = append(out.Any, privilege)
+		if all {
+			out.All = append(out.All, privilege)
+		}
+	}
+	return out, rows.Err()
+}
+
+func (p *processor) GrantPrivileges(ctx context.Context, db *sql.DB, target GrantTarget, privileges []string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"GRANT %s ON %s TO \"%s\"",
+		strings.Join(privileges, ", "),
+		grantObjects(target),
+		target.User,
+	))
+	return err
+}
+
+func (p *processor) RevokePrivileges(ctx context.Context, db *sql.DB, target GrantTarget, privileges []string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"REVOKE %s ON %s FROM \"%s\"",
+		strings.Join(privileges, ", "),
+		grantObjects(target),
+		target.User,
+	))
+	return err
+}
+
+func (p *processor) RecordGrant(ctx context.Context, db *sql.DB, database, user string, schemas []string) error {
+	if _, err := db.ExecContext(ctx, grantsTable); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(schemas)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(
+		ctx,
+		`INSERT INTO crunchy_users.grants (database, "user", schemas) VALUES ($1, $2, $3)
+		ON CONFLICT (database, "user") DO UPDATE SET schemas = EXCLUDED.schemas`,
+		database,
+		user,
+		string(raw),
+	)
+	return err
+}
+
+func (p *processor) ForgetGrant(ctx context.Context, db *sql.DB, database, user string) error {
+	if _, err := db.ExecContext(ctx, grantsTable); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(
+		ctx,
+		`DELETE FROM crunchy_users.grants WHERE database = $1 AND "user" = $2`,
+		database,
+		user,
+	)
+	return err
+}
+
+// Returns the schemas of the recorded grants by database and user.
+// The table is only created once a grant is recorded, so clusters
+// that don't use grants are left alone
+func (p *processor) RecordedGrants(ctx context.Context, db *sql.DB) (map[string]map[string][]string, error) {
+	out := map[string]map[string][]string{}
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass('crunchy_users.grants') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return out, nil
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT database, "user", schemas::text FROM crunchy_users.grants`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var database, user, raw string
+		if err := rows.Scan(&database, &user, &raw); err != nil {
+			return nil, err
+		}
+		schemas := []string{}
+		if err := json.Unmarshal([]byte(raw), &schemas); err != nil {
+			return nil, err
+		}
+		if _, ok := out[database]; !ok {
+			out[database] = map[string][]string{}
+		}
+		out[database][user] = schemas
+	}
+	return out, rows.Err()
+}
+
+func grantObjects(target GrantTarget) string {
+	switch target.Objects {
+	case GrantDatabase:
+		return fmt.Sprintf("DATABASE \"%s\"", target.Database)
+	case GrantSchema:
+		return fmt.Sprintf("SCHEMA \"%s\"", target.Schema)
+	default:
+		return fmt.Sprintf("ALL %s IN SCHEMA \"%s\"", target.Objects, target.Schema)
+	}
+}
+
+// Reconciles the grants declared for a database. Only grants that
+// crunchy-users recorded are revoked once they are no longer
+// declared, along with the schemas a grant no longer covers, so
+// privileges granted some other way are left alone.
+func handleGrants(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	cluster k8s.ClusterResult,
+	database string,
+	recorded map[string][]string,
+) {
+	l := logger.With("database", database)
+	l.Debug("processing grants")
+
+	if exists, err := processor.DatabaseExists(ctx, db, cluster.Key(), database); err != nil {
+		l.Errorw("could not determine if database exists", "error", err)
+		return
+	} else if !exists {
+		l.Debug("database does not exist, skipping")
+		return
+	}
+	ddb, err := getDatabaseDb(ctx, cluster, database)
+	if err != nil {
+		l.Errorw("could not connect to database", "error", err)
+		return
+	}
+
+	grants := cluster.Grants[database]
+	declared := []string{}
+	for _, grant := range grants {
+		declared = append(declared, grant.User)
+	}
+	for _, user := range sortedKeys(recorded) {
+		if !slices.Contains(declared, user) {
+			grants = append(grants, k8s.DatabaseGrant{
+				Database: database,
+				User:     user,
+				Level:    "none",
+				Schemas:  recorded[user],
+			})
+		}
+	}
+
+	for _, grant := range grants {
+		lu := l.With("user", grant.User, "level", grant.Level)
+		level, ok := grantLevels[strings.ToLower(grant.Level)]
+		if !ok {
+			lu.Errorw("unknown grant level")
+			continue
+		}
+		_, tracked := recorded[grant.User]
+		if exists, err := processor.UserExists(ctx, ddb, grant.User); err != nil {
+			lu.Errorw("could not determine is user exists", "error", err)
+			continue
+		} else if !exists {
+			lu.Debug("user does not exist, skipping")
+			if tracked {
+				if err := processor.ForgetGrant(ctx, db, database, grant.User); err != nil {
+					lu.Errorw("could not forget grant", "error", err)
+				}
+			}
+			continue
+		}
+
+		// Schemas the grant used to cover have everything revoked
+		schemas := grant.GrantSchemas()
+		stale, _ := diff(recorded[grant.User], schemas)
+		targets := []GrantTarget{{User: grant.User, Database: database, Objects: GrantDatabase}}
+		for _, schema := range append(append([]string{}, schemas...), stale...) {
+			for _, objects := range []string{GrantSchema, GrantTables, GrantSequences} {
+				targets = append(targets, GrantTarget{
+					User:     grant.User,
+					Database: database,
+					Schema:   schema,
+					Objects:  objects,
+				})
+			}
+		}
+
+		failed := false
+		for _, target := range targets {
+			lo := lu.With("objects", target.Objects, "schema", target.Schema)
+			desired := level[target.Objects]
+			if slices.Contains(stale, target.Schema) {
+				desired = nil
+			}
+			current, err := processor.Privileges(ctx, ddb, target)
+			if err != nil {
+				lo.Errorw("could not get current privileges", "error", err)
+				failed = true
+				continue
+			}
+			if current.Empty {
+				lo.Debug("no objects in schema, skipping")
+				continue
+			}
+			missing, _ := diff(desired, current.All)
+			_, revoke := diff(desired, current.Any)
+			if len(missing) > 0 {
+				if err := processor.GrantPrivileges(ctx, ddb, target, missing); err != nil {
+					lo.Errorw("could not grant privileges", "error", err)
+					failed = true
+				} else {
+					changed(lo, "granted privileges", "privileges", missing)
+				}
+			}
+			if len(revoke) > 0 {
+				if err := processor.RevokePrivileges(ctx, ddb, target, revoke); err != nil {
+					lo.Errorw("could not revoke privileges", "error", err)
+					failed = true
+				} else {
+					changed(lo, "revoked privileges", "privileges", revoke)
+				}
+			}
+		}
+
+		// Only update the record once everything has been applied,
+		// so anything that failed is retried
+		if failed {
+			continue
+		}
+		if strings.ToLower(grant.Level) == "none" {
+			if tracked {
+				if err := processor.ForgetGrant(ctx, db, database, grant.User); err != nil {
+					lu.Errorw("could not forget grant", "error", err)
+				}
+			}
+		} else if !tracked || !sameSchemas(recorded[grant.User], schemas) {
+			if err := processor.RecordGrant(ctx, db, database, grant.User, schemas); err != nil {
+				lu.Errorw("could not record grant", "error", err)
+			}
+		}
+	}
+}
+
+func sameSchemas(a, b []string) bool {
+	missing, extra := diff(a, b)
+	return len(missing) == 0 && len(extra) == 0
+}
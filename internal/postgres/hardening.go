@@ -0,0 +1,196 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
+	"go.uber.org/zap"
+)
+
+// The roles crunchy creates for its own components, which need to
+// connect to every database: pgBouncer looks up passwords as
+// _crunchypgbouncer, and the exporter collects metrics as
+// ccp_monitoring
+var systemRoles = []string{"_crunchypgbouncer", "ccp_monitoring"}
+
+func (p *processor) PublicDatabasePrivileges(ctx context.Context, db *sql.DB, database string) ([]string, error) {
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT acl.privilege_type
+		FROM pg_catalog.pg_database d
+		CROSS JOIN LATERAL aclexplode(COALESCE(d.datacl, acldefault('d', d.datdba))) acl
+		WHERE d.datname = $1 AND acl.grantee = 0`,
+		database,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []string{}
+	for rows.Next() {
+		var privilege string
+		if err := rows.Scan(&privilege); err != nil {
+			return nil, err
+		}
+		out = append(out, privilege)
+	}
+	return out, rows.Err()
+}
+
+func (p *processor) RevokePublicDatabasePrivileges(ctx context.Context, db *sql.DB, database string, privileges []string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"REVOKE %s ON DATABASE \"%s\" FROM PUBLIC",
+		strings.Join(privileges, ", "),
+		database,
+	))
+	return err
+}
+
+func (p *processor) PublicCanCreateInPublicSchema(ctx context.Context, db *sql.DB) (bool, error) {
+	row := db.QueryRowContext(
+		ctx,
+		`SELECT EXISTS (
+			SELECT 1
+			FROM pg_catalog.pg_namespace n
+			CROSS JOIN LATERAL aclexplode(COALESCE(n.nspacl, acldefault('n', n.nspowner))) acl
+			WHERE n.nspname = 'public' AND acl.grantee = 0 AND acl.privilege_type = 'CREATE'
+		)`,
+	)
+	var create bool
+	if err := row.Scan(&create); err != nil {
+		return false, err
+	}
+	return create, nil
+}
+
+func (p *processor) RevokePublicSchemaCreate(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, "REVOKE CREATE ON SCHEMA public FROM PUBLIC")
+	return err
+}
+
+// Locks down a database so only its owner and declared users can
+// connect, and nobody else can create objects in the public schema
+func handleHardening(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	cluster k8s.ClusterResult,
+	database string,
+	users []string,
+) {
+	l := logger.With("database", database)
+	l.Debug("hardening database")
+
+	if exists, err := processor.DatabaseExists(ctx, db, cluster.Key(), database); err != nil {
+		l.Errorw("could not determine if database exists", "error", err)
+		return
+	} else if !exists {
+		l.Debug("database does not exist, skipping")
+		return
+	}
+
+	owner, err := processor.DatabaseOwner(ctx, db, database)
+	if err != nil {
+		l.Errorw("could not get database owner", "error", err)
+		return
+	}
+
+	// Grant the declared users CONNECT before revoking it from
+	// PUBLIC, so they never lose access
+	for _, user := range users {
+		lu := l.With("user", user)
+		if exists, err := processor.UserExists(ctx, db, user); err != nil {
+			lu.Errorw("could not determine is user exists", "error", err)
+			continue
+		} else if !exists {
+			continue
+		}
+		if user == owner {
+			continue
+		}
+		target := GrantTarget{User: user, Database: database, Objects: GrantDatabase}
+		current, err := processor.Privileges(ctx, db, target)
+		if err != nil {
+			lu.Errorw("could not get current privileges", "error", err)
+			continue
+		}
+		if !slices.Contains(current.All, "CONNECT") {
+			if err := processor.GrantPrivileges(ctx, db, target, []string{"CONNECT"}); err != nil {
+				lu.Errorw("could not grant connect", "error", err)
+			} else {
+				changed(lu, "granted connect")
+			}
+		}
+	}
+
+	public, err := processor.PublicDatabasePrivileges(ctx, db, database)
+	if err != nil {
+		l.Errorw("could not get public database privileges", "error", err)
+		return
+	}
+	revoke := []string{}
+	if slices.Contains(public, "CONNECT") {
+		revoke = append(revoke, "CONNECT")
+	}
+	if cluster.HardenRevokeTemporary && slices.Contains(public, "TEMPORARY") {
+		revoke = append(revoke, "TEMPORARY")
+	}
+	if len(revoke) > 0 {
+		if err := processor.RevokePublicDatabasePrivileges(ctx, db, database, revoke); err != nil {
+			l.Errorw("could not revoke database privileges from public", "error", err)
+		} else {
+			changed(l, "revoked database privileges from public", "privileges", revoke)
+		}
+	}
+
+	ddb, err := getDatabaseDb(ctx, cluster, database)
+	if err != nil {
+		l.Errorw("could not connect to database", "error", err)
+		return
+	}
+	if create, err := processor.PublicCanCreateInPublicSchema(ctx, ddb); err != nil {
+		l.Errorw("could not determine if public can create in the public schema", "error", err)
+	} else if create {
+		if err := processor.RevokePublicSchemaCreate(ctx, ddb); err != nil {
+			l.Errorw("could not revoke create on the public schema from public", "error", err)
+		} else {
+			changed(l, "revoked create on the public schema from public")
+		}
+	}
+}
+
+// The databases managed in the cluster and the users that should be
+// able to connect to them, from spec.users and the grants annotation,
+// along with crunchy's system roles
+func hardenedDatabases(cluster k8s.ClusterResult) map[string][]string {
+	out := map[string][]string{}
+	add := func(database, user string) {
+		if !slices.Contains(out[database], user) {
+			out[database] = append(out[database], user)
+		}
+	}
+	for _, user := range cluster.Users {
+		for _, database := range user.Databases {
+			add(database, user.Name)
+		}
+	}
+	for database, grants := range cluster.Grants {
+		for _, grant := range grants {
+			if strings.ToLower(grant.Level) != "none" {
+				add(database, grant.User)
+			}
+		}
+	}
+	for database := range out {
+		for _, role := range systemRoles {
+			add(database, role)
+		}
+	}
+	return out
+}
@@ -0,0 +1,408 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
+	"github.com/henrywhitaker3/crunchy-users/internal/metrics"
+)
+
+// Wraps a Processor to count the errors returned by each operation,
+// and the DDL statements run by the ones that change the cluster.
+// Scheduling cron jobs and keeping track of what has been done only
+// change rows, so they aren't counted as statements
+type instrumented struct {
+	Processor
+}
+
+func observe(operation string, err error) error {
+	if err != nil {
+		metrics.SQLErrors.WithLabelValues(operation).Inc()
+	}
+	return err
+}
+
+func statement(operation string, err error) error {
+	if err == nil {
+		metrics.DDLStatements.WithLabelValues(operation).Inc()
+	}
+	return observe(operation, err)
+}
+
+func (p instrumented) UserExists(ctx context.Context, db *sql.DB, name string) (bool, error) {
+	out, err := p.Processor.UserExists(ctx, db, name)
+	return out, observe("UserExists", err)
+}
+
+func (p instrumented) UserIsOwner(ctx context.Context, db *sql.DB, cluster, user, database string) (bool, error) {
+	out, err := p.Processor.UserIsOwner(ctx, db, cluster, user, database)
+	return out, observe("UserIsOwner", err)
+}
+
+func (p instrumented) DatabaseOwner(ctx context.Context, db *sql.DB, database string) (string, error) {
+	out, err := p.Processor.DatabaseOwner(ctx, db, database)
+	return out, observe("DatabaseOwner", err)
+}
+
+func (p instrumented) RoleAttributes(ctx context.Context, db *sql.DB, user string) (RoleAttributes, error) {
+	out, err := p.Processor.RoleAttributes(ctx, db, user)
+	return out, observe("RoleAttributes", err)
+}
+
+func (p instrumented) AlterRole(ctx context.Context, db *sql.DB, user string, options []string) error {
+	return statement("AlterRole", p.Processor.AlterRole(ctx, db, user, options))
+}
+
+func (p instrumented) RoleMemberships(ctx context.Context, db *sql.DB, user string) ([]string, error) {
+	out, err := p.Processor.RoleMemberships(ctx, db, user)
+	return out, observe("RoleMemberships", err)
+}
+
+func (p instrumented) CreateGroupRole(ctx context.Context, db *sql.DB, role string) error {
+	return statement("CreateGroupRole", p.Processor.CreateGroupRole(ctx, db, role))
+}
+
+func (p instrumented) GrantRole(ctx context.Context, db *sql.DB, role, user string) error {
+	return statement("GrantRole", p.Processor.GrantRole(ctx, db, role, user))
+}
+
+func (p instrumented) RevokeRole(ctx context.Context, db *sql.DB, role, user string) error {
+	return statement("RevokeRole", p.Processor.RevokeRole(ctx, db, role, user))
+}
+
+func (p instrumented) RoleSettings(ctx context.Context, db *sql.DB, user string) (map[string]map[string]string, error) {
+	out, err := p.Processor.RoleSettings(ctx, db, user)
+	return out, observe("RoleSettings", err)
+}
+
+func (p instrumented) SetRoleSetting(ctx context.Context, db *sql.DB, user, database, name, value string) error {
+	return statement("SetRoleSetting", p.Processor.SetRoleSetting(ctx, db, user, database, name, value))
+}
+
+func (p instrumented) ResetRoleSetting(ctx context.Context, db *sql.DB, user, database, name string) error {
+	return statement("ResetRoleSetting", p.Processor.ResetRoleSetting(ctx, db, user, database, name))
+}
+
+func (p instrumented) DatabaseExists(ctx context.Context, db *sql.DB, cluster string, database string) (bool, error) {
+	out, err := p.Processor.DatabaseExists(ctx, db, cluster, database)
+	return out, observe("DatabaseExists", err)
+}
+
+func (p instrumented) IsTemplateDatabase(ctx context.Context, db *sql.DB, database string) (bool, error) {
+	out, err := p.Processor.IsTemplateDatabase(ctx, db, database)
+	return out, observe("IsTemplateDatabase", err)
+}
+
+func (p instrumented) MakeUserOwner(ctx context.Context, db *sql.DB, database, user string) error {
+	return statement("MakeUserOwner", p.Processor.MakeUserOwner(ctx, db, database, user))
+}
+
+func (p instrumented) CreateDatabase(ctx context.Context, db *sql.DB, spec k8s.DatabaseSpec) error {
+	return statement("CreateDatabase", p.Processor.CreateDatabase(ctx, db, spec))
+}
+
+func (p instrumented) DatabaseOptions(ctx context.Context, db *sql.DB, database string) (k8s.DatabaseSpec, error) {
+	out, err := p.Processor.DatabaseOptions(ctx, db, database)
+	return out, observe("DatabaseOptions", err)
+}
+
+func (p instrumented) DatabaseSettings(ctx context.Context, db *sql.DB, database string) (map[string]string, error) {
+	out, err := p.Processor.DatabaseSettings(ctx, db, database)
+	return out, observe("DatabaseSettings", err)
+}
+
+func (p instrumented) SetDatabaseSetting(ctx context.Context, db *sql.DB, database, name, value string) error {
+	return statement("SetDatabaseSetting", p.Processor.SetDatabaseSetting(ctx, db, database, name, value))
+}
+
+func (p instrumented) ResetDatabaseSetting(ctx context.Context, db *sql.DB, database, name string) error {
+	return statement("ResetDatabaseSetting", p.Processor.ResetDatabaseSetting(ctx, db, database, name))
+}
+
+func (p instrumented) RecordDatabaseSetting(ctx context.Context, db *sql.DB, database, name string) error {
+	return observe("RecordDatabaseSetting", p.Processor.RecordDatabaseSetting(ctx, db, database, name))
+}
+
+func (p instrumented) ForgetDatabaseSetting(ctx context.Context, db *sql.DB, database, name string) error {
+	return observe("ForgetDatabaseSetting", p.Processor.ForgetDatabaseSetting(ctx, db, database, name))
+}
+
+func (p instrumented) RecordedDatabaseSettings(ctx context.Context, db *sql.DB) (map[string][]string, error) {
+	out, err := p.Processor.RecordedDatabaseSettings(ctx, db)
+	return out, observe("RecordedDatabaseSettings", err)
+}
+
+func (p instrumented) ServerVersion(ctx context.Context, db *sql.DB) (int, error) {
+	out, err := p.Processor.ServerVersion(ctx, db)
+	return out, observe("ServerVersion", err)
+}
+
+func (p instrumented) AppliedMigrations(ctx context.Context, db *sql.DB) (map[string]string, error) {
+	out, err := p.Processor.AppliedMigrations(ctx, db)
+	return out, observe("AppliedMigrations", err)
+}
+
+func (p instrumented) ApplyMigration(ctx context.Context, db *sql.DB, migration k8s.Migration) error {
+	return statement("ApplyMigration", p.Processor.ApplyMigration(ctx, db, migration))
+}
+
+func (p instrumented) CronJobs(ctx context.Context, db *sql.DB) ([]ScheduledJob, error) {
+	out, err := p.Processor.CronJobs(ctx, db)
+	return out, observe("CronJobs", err)
+}
+
+func (p instrumented) ScheduleCronJob(ctx context.Context, db *sql.DB, job k8s.CronJob) error {
+	return observe("ScheduleCronJob", p.Processor.ScheduleCronJob(ctx, db, job))
+}
+
+func (p instrumented) UnscheduleCronJob(ctx context.Context, db *sql.DB, id int64) error {
+	return observe("UnscheduleCronJob", p.Processor.UnscheduleCronJob(ctx, db, id))
+}
+
+func (p instrumented) RecordCronJob(ctx context.Context, db *sql.DB, name string) error {
+	return observe("RecordCronJob", p.Processor.RecordCronJob(ctx, db, name))
+}
+
+func (p instrumented) ForgetCronJob(ctx context.Context, db *sql.DB, name string) error {
+	return observe("ForgetCronJob", p.Processor.ForgetCronJob(ctx, db, name))
+}
+
+func (p instrumented) ManagedCronJobs(ctx context.Context, db *sql.DB) ([]string, error) {
+	out, err := p.Processor.ManagedCronJobs(ctx, db)
+	return out, observe("ManagedCronJobs", err)
+}
+
+func (p instrumented) ForeignServerOptions(ctx context.Context, db *sql.DB, server string) (map[string]string, bool, error) {
+	out, ok, err := p.Processor.ForeignServerOptions(ctx, db, server)
+	return out, ok, observe("ForeignServerOptions", err)
+}
+
+func (p instrumented) CreateForeignServer(ctx context.Context, db *sql.DB, server string, options map[string]string) error {
+	return statement("CreateForeignServer", p.Processor.CreateForeignServer(ctx, db, server, options))
+}
+
+func (p instrumented) AlterForeignServer(ctx context.Context, db *sql.DB, server string, options []string) error {
+	return statement("AlterForeignServer", p.Processor.AlterForeignServer(ctx, db, server, options))
+}
+
+func (p instrumented) UserMappingOptions(ctx context.Context, db *sql.DB, server, user string) (map[string]string, bool, error) {
+	out, ok, err := p.Processor.UserMappingOptions(ctx, db, server, user)
+	return out, ok, observe("UserMappingOptions", err)
+}
+
+func (p instrumented) CreateUserMapping(ctx context.Context, db *sql.DB, server, user string, options map[string]string) error {
+	return statement("CreateUserMapping", p.Processor.CreateUserMapping(ctx, db, server, user, options))
+}
+
+func (p instrumented) AlterUserMapping(ctx context.Context, db *sql.DB, server, user string, options []string) error {
+	return statement("AlterUserMapping", p.Processor.AlterUserMapping(ctx, db, server, user, options))
+}
+
+func (p instrumented) HasForeignTables(ctx context.Context, db *sql.DB, server, schema string) (bool, error) {
+	out, err := p.Processor.HasForeignTables(ctx, db, server, schema)
+	return out, observe("HasForeignTables", err)
+}
+
+func (p instrumented) ImportForeignSchema(ctx context.Context, db *sql.DB, server, remote, local string) error {
+	return statement("ImportForeignSchema", p.Processor.ImportForeignSchema(ctx, db, server, remote, local))
+}
+
+func (p instrumented) Publication(ctx context.Context, db *sql.DB, publication string) (PublicationState, bool, error) {
+	out, ok, err := p.Processor.Publication(ctx, db, publication)
+	return out, ok, observe("Publication", err)
+}
+
+func (p instrumented) CreatePublication(ctx context.Context, db *sql.DB, publication k8s.Publication) error {
+	return statement("CreatePublication", p.Processor.CreatePublication(ctx, db, publication))
+}
+
+func (p instrumented) AddPublicationTables(ctx context.Context, db *sql.DB, publication string, tables []string) error {
+	return statement("AddPublicationTables", p.Processor.AddPublicationTables(ctx, db, publication, tables))
+}
+
+func (p instrumented) DropPublicationTables(ctx context.Context, db *sql.DB, publication string, tables []string) error {
+	return statement("DropPublicationTables", p.Processor.DropPublicationTables(ctx, db, publication, tables))
+}
+
+func (p instrumented) Subscription(ctx context.Context, db *sql.DB, subscription string) (SubscriptionState, bool, error) {
+	out, ok, err := p.Processor.Subscription(ctx, db, subscription)
+	return out, ok, observe("Subscription", err)
+}
+
+func (p instrumented) CreateSubscription(ctx context.Context, db *sql.DB, subscription, conninfo string, publications []string) error {
+	return statement("CreateSubscription", p.Processor.CreateSubscription(ctx, db, subscription, conninfo, publications))
+}
+
+func (p instrumented) SetSubscriptionConnection(ctx context.Context, db *sql.DB, subscription, conninfo string) error {
+	return statement("SetSubscriptionConnection", p.Processor.SetSubscriptionConnection(ctx, db, subscription, conninfo))
+}
+
+func (p instrumented) SetSubscriptionPublications(ctx context.Context, db *sql.DB, subscription string, publications []string) error {
+	return statement("SetSubscriptionPublications", p.Processor.SetSubscriptionPublications(ctx, db, subscription, publications))
+}
+
+func (p instrumented) RefreshSubscription(ctx context.Context, db *sql.DB, subscription string) error {
+	return statement("RefreshSubscription", p.Processor.RefreshSubscription(ctx, db, subscription))
+}
+
+func (p instrumented) SubscribedTables(ctx context.Context, db *sql.DB, subscription string) ([]string, error) {
+	out, err := p.Processor.SubscribedTables(ctx, db, subscription)
+	return out, observe("SubscribedTables", err)
+}
+
+func (p instrumented) PublishedTables(ctx context.Context, conninfo string, publications []string) ([]string, error) {
+	out, err := p.Processor.PublishedTables(ctx, conninfo, publications)
+	return out, observe("PublishedTables", err)
+}
+
+func (p instrumented) ReplicationSlot(ctx context.Context, db *sql.DB, slot string) (ReplicationSlot, bool, error) {
+	out, ok, err := p.Processor.ReplicationSlot(ctx, db, slot)
+	return out, ok, observe("ReplicationSlot", err)
+}
+
+func (p instrumented) CreateReplicationSlot(ctx context.Context, db *sql.DB, slot, plugin string) error {
+	return statement("CreateReplicationSlot", p.Processor.CreateReplicationSlot(ctx, db, slot, plugin))
+}
+
+func (p instrumented) TablesWithoutSelect(ctx context.Context, db *sql.DB, user string, tables []string) ([]string, error) {
+	out, err := p.Processor.TablesWithoutSelect(ctx, db, user, tables)
+	return out, observe("TablesWithoutSelect", err)
+}
+
+func (p instrumented) GrantSelect(ctx context.Context, db *sql.DB, user string, tables []string) error {
+	return statement("GrantSelect", p.Processor.GrantSelect(ctx, db, user, tables))
+}
+
+func (p instrumented) PublicDatabasePrivileges(ctx context.Context, db *sql.DB, database string) ([]string, error) {
+	out, err := p.Processor.PublicDatabasePrivileges(ctx, db, database)
+	return out, observe("PublicDatabasePrivileges", err)
+}
+
+func (p instrumented) RevokePublicDatabasePrivileges(ctx context.Context, db *sql.DB, database string, privileges []string) error {
+	return statement("RevokePublicDatabasePrivileges", p.Processor.RevokePublicDatabasePrivileges(ctx, db, database, privileges))
+}
+
+func (p instrumented) PublicCanCreateInPublicSchema(ctx context.Context, db *sql.DB) (bool, error) {
+	out, err := p.Processor.PublicCanCreateInPublicSchema(ctx, db)
+	return out, observe("PublicCanCreateInPublicSchema", err)
+}
+
+func (p instrumented) RevokePublicSchemaCreate(ctx context.Context, db *sql.DB) error {
+	return statement("RevokePublicSchemaCreate", p.Processor.RevokePublicSchemaCreate(ctx, db))
+}
+
+func (p instrumented) OwnedObjects(ctx context.Context, db *sql.DB, owner string) ([]DatabaseObject, error) {
+	out, err := p.Processor.OwnedObjects(ctx, db, owner)
+	return out, observe("OwnedObjects", err)
+}
+
+func (p instrumented) ReassignObject(ctx context.Context, db *sql.DB, obj DatabaseObject, owner string) error {
+	return statement("ReassignObject", p.Processor.ReassignObject(ctx, db, obj, owner))
+}
+
+func (p instrumented) ExtensionExists(ctx context.Context, db *sql.DB, name string) (bool, error) {
+	out, err := p.Processor.ExtensionExists(ctx, db, name)
+	return out, observe("ExtensionExists", err)
+}
+
+func (p instrumented) CreateExtension(ctx context.Context, db *sql.DB, name string, cascade bool, version, schema string) error {
+	return statement("CreateExtension", p.Processor.CreateExtension(ctx, db, name, cascade, version, schema))
+}
+
+func (p instrumented) ExtensionVersion(ctx context.Context, db *sql.DB, name string) (string, error) {
+	out, err := p.Processor.ExtensionVersion(ctx, db, name)
+	return out, observe("ExtensionVersion", err)
+}
+
+func (p instrumented) UpdateExtension(ctx context.Context, db *sql.DB, name, version string) error {
+	return statement("UpdateExtension", p.Processor.UpdateExtension(ctx, db, name, version))
+}
+
+func (p instrumented) ExtensionSchema(ctx context.Context, db *sql.DB, name string) (string, bool, error) {
+	out, ok, err := p.Processor.ExtensionSchema(ctx, db, name)
+	return out, ok, observe("ExtensionSchema", err)
+}
+
+func (p instrumented) SetExtensionSchema(ctx context.Context, db *sql.DB, name, schema string) error {
+	return statement("SetExtensionSchema", p.Processor.SetExtensionSchema(ctx, db, name, schema))
+}
+
+func (p instrumented) DropExtension(ctx context.Context, db *sql.DB, name string, cascade bool) error {
+	return statement("DropExtension", p.Processor.DropExtension(ctx, db, name, cascade))
+}
+
+func (p instrumented) RecordExtension(ctx context.Context, db *sql.DB, database, name string) error {
+	return observe("RecordExtension", p.Processor.RecordExtension(ctx, db, database, name))
+}
+
+func (p instrumented) ForgetExtension(ctx context.Context, db *sql.DB, database, name string) error {
+	return observe("ForgetExtension", p.Processor.ForgetExtension(ctx, db, database, name))
+}
+
+func (p instrumented) InstalledExtensions(ctx context.Context, db *sql.DB, database string) ([]string, error) {
+	out, err := p.Processor.InstalledExtensions(ctx, db, database)
+	return out, observe("InstalledExtensions", err)
+}
+
+func (p instrumented) ExtensionDatabases(ctx context.Context, db *sql.DB) ([]string, error) {
+	out, err := p.Processor.ExtensionDatabases(ctx, db)
+	return out, observe("ExtensionDatabases", err)
+}
+
+func (p instrumented) SchemaExists(ctx context.Context, db *sql.DB, schema string) (bool, error) {
+	out, err := p.Processor.SchemaExists(ctx, db, schema)
+	return out, observe("SchemaExists", err)
+}
+
+func (p instrumented) CreateSchema(ctx context.Context, db *sql.DB, schema, authorization string) error {
+	return statement("CreateSchema", p.Processor.CreateSchema(ctx, db, schema, authorization))
+}
+
+func (p instrumented) SchemaIsOwner(ctx context.Context, db *sql.DB, schema, user string) (bool, error) {
+	out, err := p.Processor.SchemaIsOwner(ctx, db, schema, user)
+	return out, observe("SchemaIsOwner", err)
+}
+
+func (p instrumented) MakeSchemaOwner(ctx context.Context, db *sql.DB, schema, user string) error {
+	return statement("MakeSchemaOwner", p.Processor.MakeSchemaOwner(ctx, db, schema, user))
+}
+
+func (p instrumented) DefaultPrivileges(ctx context.Context, db *sql.DB, target DefaultPrivilegeTarget) ([]string, error) {
+	out, err := p.Processor.DefaultPrivileges(ctx, db, target)
+	return out, observe("DefaultPrivileges", err)
+}
+
+func (p instrumented) GrantDefaultPrivileges(ctx context.Context, db *sql.DB, target DefaultPrivilegeTarget, privileges []string) error {
+	return statement("GrantDefaultPrivileges", p.Processor.GrantDefaultPrivileges(ctx, db, target, privileges))
+}
+
+func (p instrumented) RevokeDefaultPrivileges(ctx context.Context, db *sql.DB, target DefaultPrivilegeTarget, privileges []string) error {
+	return statement("RevokeDefaultPrivileges", p.Processor.RevokeDefaultPrivileges(ctx, db, target, privileges))
+}
+
+func (p instrumented) Privileges(ctx context.Context, db *sql.DB, target GrantTarget) (Privileges, error) {
+	out, err := p.Processor.Privileges(ctx, db, target)
+	return out, observe("Privileges", err)
+}
+
+func (p instrumented) GrantPrivileges(ctx context.Context, db *sql.DB, target GrantTarget, privileges []string) error {
+	return statement("GrantPrivileges", p.Processor.GrantPrivileges(ctx, db, target, privileges))
+}
+
+func (p instrumented) RevokePrivileges(ctx context.Context, db *sql.DB, target GrantTarget, privileges []string) error {
+	return statement("RevokePrivileges", p.Processor.RevokePrivileges(ctx, db, target, privileges))
+}
+
+func (p instrumented) RecordGrant(ctx context.Context, db *sql.DB, database, user string, schemas []string) error {
+	return observe("RecordGrant", p.Processor.RecordGrant(ctx, db, database, user, schemas))
+}
+
+func (p instrumented) ForgetGrant(ctx context.Context, db *sql.DB, database, user string) error {
+	return observe("ForgetGrant", p.Processor.ForgetGrant(ctx, db, database, user))
+}
+
+func (p instrumented) RecordedGrants(ctx context.Context, db *sql.DB) (map[string]map[string][]string, error) {
+	out, err := p.Processor.RecordedGrants(ctx, db)
+	return out, observe("RecordedGrants", err)
+}
@@ -0,0 +1,115 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
+	"go.uber.org/zap"
+)
+
+// Migrations are recorded in the database they are applied to, so
+// the migration and its record are committed together
+const migrationsTable = `CREATE SCHEMA IF NOT EXISTS crunchy_users;
+CREATE TABLE IF NOT EXISTS crunchy_users.migrations (
+	version text PRIMARY KEY,
+	checksum text NOT NULL,
+	applied_at timestamptz NOT NULL DEFAULT now()
+);`
+
+func (p *processor) AppliedMigrations(ctx context.Context, db *sql.DB) (map[string]string, error) {
+	if _, err := db.ExecContext(ctx, migrationsTable); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT version, checksum FROM crunchy_users.migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string]string{}
+	for rows.Next() {
+		var version, checksum string
+		if err := rows.Scan(&version, &checksum); err != nil {
+			return nil, err
+		}
+		out[version] = checksum
+	}
+	return out, rows.Err()
+}
+
+func (p *processor) ApplyMigration(ctx context.Context, db *sql.DB, migration k8s.Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, migration.SQL); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(
+		ctx,
+		"INSERT INTO crunchy_users.migrations (version, checksum) VALUES ($1, $2)",
+		migration.Version,
+		migration.Checksum(),
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Applies the database's pending migrations in order. Nothing is
+// applied when a migration that has already run has been changed,
+// and a failed migration stops the ones after it.
+func handleMigrations(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	cluster k8s.ClusterResult,
+	database string,
+) {
+	l := logger.With("database", database)
+	l.Debug("processing migrations")
+
+	if exists, err := processor.DatabaseExists(ctx, db, cluster.Key(), database); err != nil {
+		l.Errorw("could not determine if database exists", "error", err)
+		return
+	} else if !exists {
+		l.Debug("database does not exist, skipping")
+		return
+	}
+
+	ddb, err := getDatabaseDb(ctx, cluster, database)
+	if err != nil {
+		l.Errorw("could not connect to database", "error", err)
+		return
+	}
+	applied, err := processor.AppliedMigrations(ctx, ddb)
+	if err != nil {
+		l.Errorw("could not get applied migrations", "error", err)
+		return
+	}
+
+	migrations := cluster.Migrations[database]
+	for _, migration := range migrations {
+		checksum, ok := applied[migration.Version]
+		if ok && checksum != migration.Checksum() {
+			l.Errorw("refusing to run migrations as an applied migration has changed", "version", migration.Version)
+			return
+		}
+	}
+
+	for _, migration := range migrations {
+		lm := l.With("version", migration.Version)
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		if err := processor.ApplyMigration(ctx, ddb, migration); err != nil {
+			lm.Errorw("could not apply migration", "error", err)
+			return
+		}
+		changed(lm, "applied migration")
+	}
+}
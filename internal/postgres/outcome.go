@@ -0,0 +1,213 @@
+package postgres
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// The field that marks a log message as a change made to the cluster
+const changeField = "change"
+
+// Logs a change once it has been made, so it is recorded in the
+// outcome as well as logged. Handlers call this after the statement
+// has succeeded, so failed statements are only recorded as errors.
+func changed(l *zap.SugaredLogger, message string, keysAndValues ...any) {
+	l.Debugw(message, append(keysAndValues, changeField, true)...)
+}
+
+// The outcome of processing a cluster. The handlers log what they do
+// rather than returning it, so these are the errors and changes that
+// were logged, by the database they were logged for. Ones that
+// weren't for a database are under an empty string. Errors are also
+// recorded by the user and extension they were for.
+type Outcome struct {
+	Errors          map[string][]string
+	UserErrors      map[string][]string
+	ExtensionErrors map[string][]string
+	Changes         map[string][]string
+	// The number of each kind of object that was processed
+	Counts map[string]int
+}
+
+// Whether any errors were logged for the database
+func (o Outcome) Failed(database string) bool {
+	return len(o.Errors[database]) > 0
+}
+
+// The status to write to the cluster's status annotation. err is the
+// error HandleCluster returned, if any
+func (o Outcome) Status(cluster k8s.ClusterResult, err error) k8s.ClusterStatus {
+	errs := k8s.ClusterStatusErrors{
+		Cluster:    append([]string{}, o.Errors[""]...),
+		Users:      copyMessages(o.UserErrors),
+		Databases:  copyMessages(o.Errors),
+		Extensions: copyMessages(o.ExtensionErrors),
+	}
+	delete(errs.Databases, "")
+	if err != nil {
+		errs.Cluster = append(errs.Cluster, err.Error())
+	}
+	changes := 0
+	for _, messages := range o.Changes {
+		changes += len(messages)
+	}
+	return k8s.NewClusterStatus(cluster, o.Counts, changes, errs)
+}
+
+// Records the errors and changes logged through a logger
+type recorder struct {
+	mu              *sync.Mutex
+	errors          map[string][]string
+	userErrors      map[string][]string
+	extensionErrors map[string][]string
+	changes         map[string][]string
+	fields          []zapcore.Field
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		mu:              &sync.Mutex{},
+		errors:          map[string][]string{},
+		userErrors:      map[string][]string{},
+		extensionErrors: map[string][]string{},
+		changes:         map[string][]string{},
+	}
+}
+
+// Wraps the logger so its errors and changes are recorded as well
+// as logged
+func (r *recorder) wrap(logger *zap.SugaredLogger) *zap.SugaredLogger {
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(core, r)
+	}))
+}
+
+func (r *recorder) outcome() Outcome {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return Outcome{
+		Errors:          copyMessages(r.errors),
+		UserErrors:      copyMessages(r.userErrors),
+		ExtensionErrors: copyMessages(r.extensionErrors),
+		Changes:         copyMessages(r.changes),
+		Counts:          map[string]int{},
+	}
+}
+
+func (r *recorder) Enabled(level zapcore.Level) bool {
+	return level == zapcore.DebugLevel || level >= zapcore.ErrorLevel
+}
+
+func (r *recorder) With(fields []zapcore.Field) zapcore.Core {
+	return &recorder{
+		mu:              r.mu,
+		errors:          r.errors,
+		userErrors:      r.userErrors,
+		extensionErrors: r.extensionErrors,
+		changes:         r.changes,
+		fields:          append(append([]zapcore.Field{}, r.fields...), fields...),
+	}
+}
+
+func (r *recorder) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	// Whether a debug message is a change depends on its fields, so
+	// that is left to Write
+	if entry.Level >= zapcore.ErrorLevel || entry.Level == zapcore.DebugLevel {
+		return checked.AddCore(entry, r)
+	}
+	return checked
+}
+
+// Records the message along with the string fields that say what
+// it was for, e.g. "could not install extension: ... (extension=vector)"
+func (r *recorder) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	database := ""
+	user := ""
+	change := false
+	message := entry.Message
+	context := []string{}
+	extensions := map[string]string{}
+	for _, field := range append(append([]zapcore.Field{}, r.fields...), fields...) {
+		switch {
+		case field.Key == changeField && field.Type == zapcore.BoolType:
+			change = field.Integer == 1
+		case field.Key == "database" && field.Type == zapcore.StringType:
+			database = field.String
+		case field.Key == "error" && field.Type == zapcore.ErrorType:
+			if err, ok := field.Interface.(error); ok {
+				message = fmt.Sprintf("%s: %s", message, err)
+				for _, e := range extensionErrors(err) {
+					extensions[e.Extension] = e.Err.Error()
+				}
+			}
+		case field.Key == "user" && field.Type == zapcore.StringType:
+			user = field.String
+			context = append(context, fmt.Sprintf("%s=%s", field.Key, field.String))
+		case field.Key == "extension" && field.Type == zapcore.StringType:
+			extensions[field.String] = ""
+			context = append(context, fmt.Sprintf("%s=%s", field.Key, field.String))
+		case field.Key == "cluster" || field.Key == "namespace":
+		case field.Type == zapcore.StringType:
+			context = append(context, fmt.Sprintf("%s=%s", field.Key, field.String))
+		}
+	}
+	if entry.Level < zapcore.ErrorLevel && !change {
+		return nil
+	}
+	if len(context) > 0 {
+		message = fmt.Sprintf("%s (%s)", message, strings.Join(context, ", "))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry.Level < zapcore.ErrorLevel {
+		r.changes[database] = append(r.changes[database], message)
+		return nil
+	}
+	r.errors[database] = append(r.errors[database], message)
+	if user != "" {
+		r.userErrors[user] = append(r.userErrors[user], message)
+	}
+	for extension, err := range extensions {
+		if err == "" {
+			err = message
+		}
+		r.extensionErrors[extension] = append(r.extensionErrors[extension], err)
+	}
+	return nil
+}
+
+// The extension errors in an error, including the ones joined
+// together by handleExtensions
+func extensionErrors(err error) []ExtensionError {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		out := []ExtensionError{}
+		for _, e := range joined.Unwrap() {
+			out = append(out, extensionErrors(e)...)
+		}
+		return out
+	}
+	var ext ExtensionError
+	if errors.As(err, &ext) {
+		return []ExtensionError{ext}
+	}
+	return nil
+}
+
+func copyMessages(in map[string][]string) map[string][]string {
+	out := map[string][]string{}
+	for key, messages := range in {
+		out[key] = append([]string{}, messages...)
+	}
+	return out
+}
+
+func (r *recorder) Sync() error {
+	return nil
+}
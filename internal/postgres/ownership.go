@@ -0,0 +1,147 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
+	"go.uber.org/zap"
+)
+
+// An object in a database that can have its owner changed with
+// ALTER {Kind} {Identity} OWNER TO
+type DatabaseObject struct {
+	Kind string
+	// The quoted and schema qualified name of the object
+	Identity string
+}
+
+// Lists the objects owned by the role, leaving out system schemas,
+// objects that belong to extensions and objects that move with
+// their parent, such as indexes and sequences owned by a column.
+// The pgbouncer schema is left out as crunchy manages it, and the
+// crunchy_users schema as it has the records of what was applied.
+// Aggregates can't be altered with ALTER ROUTINE, so they have their
+// own kind.
+const ownedObjects = `SELECT o.kind, o.identity
+FROM (
+	SELECT CASE c.relkind
+			WHEN 'v' THEN 'VIEW'
+			WHEN 'm' THEN 'MATERIALIZED VIEW'
+			WHEN 'S' THEN 'SEQUENCE'
+			WHEN 'f' THEN 'FOREIGN TABLE'
+			ELSE 'TABLE'
+		END AS kind,
+		c.oid::regclass::text AS identity,
+		c.relowner AS owner,
+		'pg_class'::regclass AS classid,
+		c.oid AS objid,
+		c.relnamespace AS namespace
+	FROM pg_catalog.pg_class c
+	WHERE c.relkind IN ('r', 'p', 'v', 'm', 'S', 'f')
+		AND NOT (c.relkind = 'S' AND EXISTS (
+			SELECT 1 FROM pg_catalog.pg_depend d
+			WHERE d.classid = 'pg_class'::regclass
+				AND d.objid = c.oid
+				AND d.refclassid = 'pg_class'::regclass
+				AND d.deptype IN ('a', 'i')
+		))
+	UNION ALL
+	SELECT CASE p.prokind WHEN 'a' THEN 'AGGREGATE' ELSE 'ROUTINE' END, p.oid::regprocedure::text, p.proowner, 'pg_proc'::regclass, p.oid, p.pronamespace
+	FROM pg_catalog.pg_proc p
+	UNION ALL
+	SELECT 'TYPE', t.oid::regtype::text, t.typowner, 'pg_type'::regclass, t.oid, t.typnamespace
+	FROM pg_catalog.pg_type t
+	WHERE t.typtype IN ('d', 'e', 'r')
+		OR (t.typtype = 'c' AND (SELECT relkind FROM pg_catalog.pg_class WHERE oid = t.typrelid) = 'c')
+	UNION ALL
+	SELECT 'SCHEMA', quote_ident(n.nspname), n.nspowner, 'pg_namespace'::regclass, n.oid, n.oid
+	FROM pg_catalog.pg_namespace n
+) o
+JOIN pg_catalog.pg_namespace n ON n.oid = o.namespace
+JOIN pg_catalog.pg_roles r ON r.oid = o.owner
+WHERE r.rolname = $1
+	AND n.nspname NOT IN ('pg_catalog', 'information_schema', 'pgbouncer', 'crunchy_users')
+	AND n.nspname NOT LIKE 'pg\_toast%'
+	AND n.nspname NOT LIKE 'pg\_temp\_%'
+	AND NOT EXISTS (
+		SELECT 1 FROM pg_catalog.pg_depend d
+		WHERE d.classid = o.classid AND d.objid = o.objid AND d.deptype = 'e'
+	)
+ORDER BY o.kind = 'SCHEMA' DESC, o.identity`
+
+func (p *processor) ServerVersion(ctx context.Context, db *sql.DB) (int, error) {
+	row := db.QueryRowContext(ctx, "SHOW server_version_num")
+	var version string
+	if err := row.Scan(&version); err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(version)
+}
+
+func (p *processor) OwnedObjects(ctx context.Context, db *sql.DB, owner string) ([]DatabaseObject, error) {
+	rows, err := db.QueryContext(ctx, ownedObjects, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []DatabaseObject{}
+	for rows.Next() {
+		var obj DatabaseObject
+		if err := rows.Scan(&obj.Kind, &obj.Identity); err != nil {
+			return nil, err
+		}
+		out = append(out, obj)
+	}
+	return out, rows.Err()
+}
+
+func (p *processor) ReassignObject(ctx context.Context, db *sql.DB, obj DatabaseObject, owner string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER %s %s OWNER TO \"%s\"", obj.Kind, obj.Identity, owner))
+	return err
+}
+
+// Moves the objects in the database that are owned by the superuser
+// over to the database owner. The public schema is only moved on 15+,
+// where it is no longer writable by everyone.
+func handleReassignObjects(
+	ctx context.Context,
+	l *zap.SugaredLogger,
+	processor Processor,
+	cluster k8s.ClusterResult,
+	database string,
+	owner string,
+) {
+	l.Debug("reassigning superuser owned objects")
+	db, err := getDatabaseDb(ctx, cluster, database)
+	if err != nil {
+		l.Errorw("could not connect to database", "error", err)
+		return
+	}
+	version, err := processor.ServerVersion(ctx, db)
+	if err != nil {
+		l.Errorw("could not determine server version", "error", err)
+		return
+	}
+	objects, err := processor.OwnedObjects(ctx, db, cluster.Superuser.User)
+	if err != nil {
+		l.Errorw("could not get superuser owned objects", "error", err)
+		return
+	}
+
+	for _, obj := range objects {
+		lo := l.With("kind", obj.Kind, "object", obj.Identity)
+		if obj.Kind == "SCHEMA" && obj.Identity == "public" && version < 150000 {
+			lo.Debug("skipping public schema before postgres 15")
+			continue
+		}
+		if err := processor.ReassignObject(ctx, db, obj, owner); err != nil {
+			lo.Errorw("could not reassign object", "error", err)
+		} else {
+			changed(lo, "reassigned object")
+		}
+	}
+}
@@ -3,32 +3,69 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 
 	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
 	"github.com/henrywhitaker3/crunchy-users/internal/logger"
+	"github.com/henrywhitaker3/crunchy-users/internal/metrics"
 	"github.com/henrywhitaker3/flow"
+	"go.uber.org/zap"
 )
 
 var (
 	dbs = flow.NewStore[*sql.DB]()
+	// The pools in dbs, so the connections they have open can be
+	// counted
+	pools   = []*sql.DB{}
+	poolsMu = &sync.Mutex{}
 )
 
-func HandleCluster(ctx context.Context, cluster k8s.ClusterResult) error {
-	logger := logger.Logger(ctx).With("cluster", cluster.Name, "namespace", cluster.Namespace)
+func init() {
+	metrics.OpenConnections(openConnections)
+}
+
+// The number of connections open across all the pools
+func openConnections() int {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+	open := 0
+	for _, pool := range pools {
+		open += pool.Stats().OpenConnections
+	}
+	return open
+}
+
+// Processes the cluster, returning the errors that were logged
+// along the way by the database they were for
+func HandleCluster(ctx context.Context, cluster k8s.ClusterResult) (Outcome, error) {
+	rec := newRecorder()
+	logger := rec.wrap(logger.Logger(ctx).With("cluster", cluster.Name, "namespace", cluster.Namespace))
 	logger.Debug("processing cluster")
 
 	db, err := getDb(ctx, cluster.Superuser)
 	if err != nil {
 		logger.Errorw("could not open db connection", "error", err)
-		return err
+		return rec.outcome(), err
 	}
 	processor := NewProcessor()
 
 	users := 0
 	databases := 0
 	extensions := 0
+	schemas := 0
+	defaultPrivileges := 0
+	// The owner of each database, which is the first user that lists it
+	owners := map[string]string{}
+
+	for _, spec := range cluster.Databases {
+		handleDatabase(ctx, logger, processor, db, cluster, spec)
+	}
 
 	for _, user := range cluster.Users {
 		users++
@@ -44,6 +81,16 @@ func HandleCluster(ctx context.Context, cluster k8s.ClusterResult) error {
 			l.Debug("user exists")
 		}
 
+		if attrs, ok := cluster.Roles[user.Name]; ok {
+			handleRoleAttributes(ctx, l, processor, db, attrs)
+		}
+		if membership, ok := cluster.Memberships[user.Name]; ok {
+			handleRoleMemberships(ctx, l, processor, db, membership)
+		}
+		if settings, ok := cluster.RoleSettings[user.Name]; ok {
+			handleRoleSettings(ctx, l, processor, db, user.Name, settings)
+		}
+
 		for _, database := range user.Databases {
 			databases++
 			ld := l.With("database", database)
@@ -62,41 +109,392 @@ func HandleCluster(ctx context.Context, cluster k8s.ClusterResult) error {
 				ld.Errorw("could not determine if user owns the database", "error", err)
 				continue
 			} else if !owner {
-				ld.Debug("updating database owner")
 				if err := processor.MakeUserOwner(ctx, db, database, user.Name); err != nil {
 					ld.Errorw("could not update database owner", "error", err)
+				} else {
+					changed(ld, "updated database owner")
 				}
 			} else {
 				ld.Debug("user is already owner")
 			}
+			if _, ok := owners[database]; !ok {
+				owners[database] = user.Name
+			}
+		}
+	}
 
-			for _, ext := range cluster.Extensions[database] {
-				extensions++
-				le := ld.With("extension", ext.Extension)
-				le.Debugw("processing extension")
-				lu := cluster.Superuser
-				lu.Database = database
-				ddb, err := getDb(ctx, lu)
-				if err != nil {
-					le.Errorw("could not connect to database", "error", err)
-				}
-				exists, err := processor.ExtensionExists(ctx, ddb, ext.Extension)
-				if err != nil {
-					le.Errorw("could not determine if extension exists", "error", err)
-				}
-				if exists {
-					le.Debug("extension already installed")
-					continue
-				}
-				if err := processor.CreateExtension(ctx, ddb, ext.Extension, ext.Cascade); err != nil {
-					le.Errorw("could not install extension", "error", err)
-				}
+	// Objects are reassigned once per database, so a database listed
+	// by several users always goes to the same one
+	if cluster.ReassignObjects {
+		for _, database := range sortedKeys(owners) {
+			l := logger.With("database", database, "user", owners[database])
+			handleReassignObjects(ctx, l, processor, cluster, database, owners[database])
+		}
+	}
+
+	// Schemas are reconciled once per database they are declared
+	// for, whether or not a user lists it
+	for _, database := range sortedKeys(cluster.Schemas) {
+		schemas += len(cluster.Schemas[database])
+		handleSchemas(ctx, logger, processor, db, cluster, database)
+	}
+
+	// Default privileges come after schemas, which they can be
+	// declared for
+	for _, database := range sortedKeys(cluster.DefaultPrivileges) {
+		defaultPrivileges += len(cluster.DefaultPrivileges[database])
+		handleDefaultPrivileges(ctx, logger, processor, db, cluster, database)
+	}
+
+	// Extensions are reconciled once per database they are declared
+	// for, whether or not a user lists it, so they can target
+	// template databases
+	extensionDatabases := sortedKeys(cluster.Extensions)
+	if cluster.PruneExtensions {
+		// Databases whose extensions have all been removed from the
+		// annotation still need them pruning
+		installed, err := processor.ExtensionDatabases(ctx, db)
+		if err != nil {
+			logger.Errorw("could not get databases with installed extensions", "error", err)
+		}
+		for _, database := range installed {
+			if !slices.Contains(extensionDatabases, database) {
+				extensionDatabases = append(extensionDatabases, database)
 			}
 		}
 	}
-	logger.Infow("processed cluster", "users", users, "databases", databases, "extensions", extensions)
+	for _, database := range extensionDatabases {
+		extensions += len(cluster.Extensions[database])
+		if err := handleExtensions(ctx, logger, processor, db, cluster, database); err != nil {
+			logger.Errorw("could not reconcile extensions", "database", database, "error", err)
+		} else {
+			logger.Debugw("extensions reconciled", "database", database)
+		}
+	}
+
+	foreignServers := 0
+	for _, database := range sortedKeys(cluster.ForeignServers) {
+		foreignServers += len(cluster.ForeignServers[database])
+		for _, server := range cluster.ForeignServers[database] {
+			handleForeignServer(ctx, logger, processor, db, cluster, server)
+		}
+	}
+
+	migrations := 0
+	for _, database := range sortedKeys(cluster.Migrations) {
+		migrations += len(cluster.Migrations[database])
+		handleMigrations(ctx, logger, processor, db, cluster, database)
+	}
+
+	publications := 0
+	for _, database := range sortedKeys(cluster.Publications) {
+		publications += len(cluster.Publications[database])
+		for _, publication := range cluster.Publications[database] {
+			handlePublication(ctx, logger, processor, db, cluster, publication)
+		}
+	}
+	subscriptions := 0
+	for _, database := range sortedKeys(cluster.Subscriptions) {
+		subscriptions += len(cluster.Subscriptions[database])
+		for _, sub := range cluster.Subscriptions[database] {
+			handleSubscription(ctx, logger, processor, db, cluster, sub)
+		}
+	}
+	cdc := 0
+	for _, database := range sortedKeys(cluster.CDC) {
+		cdc += len(cluster.CDC[database])
+		for _, c := range cluster.CDC[database] {
+			handleCDC(ctx, logger, processor, db, cluster, c)
+		}
+	}
+
+	// Grants are reconciled for the databases they are declared for
+	// and the ones crunchy-users has granted access to before, so
+	// removed grants are revoked
+	grants := 0
+	recorded, err := processor.RecordedGrants(ctx, db)
+	if err != nil {
+		logger.Errorw("could not get recorded grants", "error", err)
+	}
+	grantDatabases := sortedKeys(cluster.Grants)
+	for _, database := range sortedKeys(recorded) {
+		if !slices.Contains(grantDatabases, database) {
+			grantDatabases = append(grantDatabases, database)
+		}
+	}
+	for _, database := range grantDatabases {
+		grants += len(cluster.Grants[database])
+		handleGrants(ctx, logger, processor, db, cluster, database, recorded[database])
+	}
 
-	return nil
+	if cluster.Harden {
+		hardened := hardenedDatabases(cluster)
+		for _, database := range sortedKeys(hardened) {
+			handleHardening(ctx, logger, processor, db, cluster, database, hardened[database])
+		}
+	}
+
+	// Settings are reconciled for the databases they are declared
+	// for and the ones crunchy-users has set them in before, so
+	// removed settings are reset
+	databaseSettings := 0
+	recordedSettings, err := processor.RecordedDatabaseSettings(ctx, db)
+	if err != nil {
+		logger.Errorw("could not get recorded database settings", "error", err)
+	}
+	settingsDatabases := sortedKeys(cluster.DatabaseSettings)
+	for _, database := range sortedKeys(recordedSettings) {
+		if !slices.Contains(settingsDatabases, database) {
+			settingsDatabases = append(settingsDatabases, database)
+		}
+	}
+	for _, database := range settingsDatabases {
+		settings, ok := cluster.DatabaseSettings[database]
+		databaseSettings += len(settings.Settings)
+		if !ok {
+			settings = k8s.DatabaseSettings{Database: database, Settings: map[string]string{}}
+		}
+		handleDatabaseSettings(ctx, logger, processor, db, cluster, settings, recordedSettings[database])
+	}
+
+	if len(cluster.CronJobs) > 0 {
+		handleCronJobs(ctx, logger, processor, db, cluster)
+	}
+
+	counts := map[string]int{
+		"users":              users,
+		"databases":          databases,
+		"extensions":         extensions,
+		"schemas":            schemas,
+		"default_privileges": defaultPrivileges,
+		"grants":             grants,
+		"database_settings":  databaseSettings,
+		"migrations":         migrations,
+		"cron_jobs":          len(cluster.CronJobs),
+		"foreign_servers":    foreignServers,
+		"publications":       publications,
+		"subscriptions":      subscriptions,
+		"cdc":                cdc,
+	}
+	fields := []any{}
+	for _, key := range sortedKeys(counts) {
+		fields = append(fields, key, counts[key])
+	}
+	logger.Infow("processed cluster", fields...)
+
+	out := rec.outcome()
+	out.Counts = counts
+	return out, nil
+}
+
+// Creates the schemas declared for a database and reconciles
+// their owners
+func handleSchemas(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	cluster k8s.ClusterResult,
+	database string,
+) {
+	l := logger.With("database", database)
+	l.Debug("processing schemas")
+
+	if exists, err := processor.DatabaseExists(ctx, db, cluster.Key(), database); err != nil {
+		l.Errorw("could not determine if database exists", "error", err)
+		return
+	} else if !exists {
+		l.Debug("database does not exist, skipping")
+		return
+	}
+	ddb, err := getDatabaseDb(ctx, cluster, database)
+	if err != nil {
+		l.Errorw("could not connect to database", "error", err)
+		return
+	}
+
+	for _, sch := range cluster.Schemas[database] {
+		ls := l.With("schema", sch.Schema)
+		ls.Debugw("processing schema")
+		owner := sch.DesiredOwner()
+		if exists, err := processor.SchemaExists(ctx, ddb, sch.Schema); err != nil {
+			ls.Errorw("could not determine if schema exists", "error", err)
+			continue
+		} else if !exists {
+			if err := processor.CreateSchema(ctx, ddb, sch.Schema, sch.Authorization); err != nil {
+				ls.Errorw("could not create schema", "error", err)
+				continue
+			}
+			changed(ls, "created schema")
+			if owner == sch.Authorization {
+				continue
+			}
+		} else {
+			ls.Debug("schema exists")
+		}
+		if owner == "" {
+			continue
+		}
+
+		if owned, err := processor.SchemaIsOwner(ctx, ddb, sch.Schema, owner); err != nil {
+			ls.Errorw("could not determine if user owns the schema", "error", err)
+		} else if !owned {
+			if err := processor.MakeSchemaOwner(ctx, ddb, sch.Schema, owner); err != nil {
+				ls.Errorw("could not update schema owner", "error", err)
+			} else {
+				changed(ls, "updated schema owner", "owner", owner)
+			}
+		} else {
+			ls.Debug("user is already schema owner")
+		}
+	}
+}
+
+func handleDefaultPrivileges(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	cluster k8s.ClusterResult,
+	database string,
+) {
+	l := logger.With("database", database)
+	if exists, err := processor.DatabaseExists(ctx, db, cluster.Key(), database); err != nil {
+		l.Errorw("could not determine if database exists", "error", err)
+		return
+	} else if !exists {
+		l.Debug("database does not exist, skipping")
+		return
+	}
+	for _, priv := range cluster.DefaultPrivileges[database] {
+		handleDefaultPrivilege(ctx, l, processor, cluster, priv)
+	}
+}
+
+func handleDefaultPrivilege(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	processor Processor,
+	cluster k8s.ClusterResult,
+	priv k8s.DefaultPrivilege,
+) {
+	l := logger.With("schema", priv.Schema, "grantor", priv.Grantor, "grantee", priv.Grantee)
+	l.Debug("processing default privileges")
+	db, err := getDatabaseDb(ctx, cluster, priv.Database)
+	if err != nil {
+		l.Errorw("could not connect to database", "error", err)
+		return
+	}
+
+	for _, objects := range []struct {
+		kind    string
+		desired []string
+	}{
+		{kind: "TABLES", desired: priv.Tables},
+		{kind: "SEQUENCES", desired: priv.Sequences},
+		{kind: "FUNCTIONS", desired: priv.Functions},
+	} {
+		lo := l.With("objects", objects.kind)
+		target := DefaultPrivilegeTarget{
+			Grantor: priv.Grantor,
+			Schema:  priv.Schema,
+			Grantee: priv.Grantee,
+			Objects: objects.kind,
+		}
+		current, err := processor.DefaultPrivileges(ctx, db, target)
+		if err != nil {
+			lo.Errorw("could not get current default privileges", "error", err)
+			continue
+		}
+		grant, revoke := diff(upper(objects.desired), current)
+		if len(grant) > 0 {
+			if err := processor.GrantDefaultPrivileges(ctx, db, target, grant); err != nil {
+				lo.Errorw("could not grant default privileges", "error", err)
+			} else {
+				changed(lo, "granted default privileges", "privileges", grant)
+			}
+		}
+		if len(revoke) > 0 {
+			if err := processor.RevokeDefaultPrivileges(ctx, db, target, revoke); err != nil {
+				lo.Errorw("could not revoke default privileges", "error", err)
+			} else {
+				changed(lo, "revoked default privileges", "privileges", revoke)
+			}
+		}
+	}
+}
+
+// Moves an installed extension to the declared schema and updates
+// it to the declared version when they have drifted
+func handleExistingExtension(
+	ctx context.Context,
+	l *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	ext k8s.DatabaseExtension,
+) error {
+	errs := []error{}
+	if ext.Schema != "" {
+		schema, relocatable, err := processor.ExtensionSchema(ctx, db, ext.Extension)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not determine extension schema: %w", err))
+		} else if schema == ext.Schema {
+			l.Debug("extension already in schema")
+		} else if !relocatable {
+			errs = append(errs, fmt.Errorf("extension is in schema %s and cannot be relocated to %s", schema, ext.Schema))
+		} else {
+			if err := processor.SetExtensionSchema(ctx, db, ext.Extension, ext.Schema); err != nil {
+				errs = append(errs, fmt.Errorf("could not move extension: %w", err))
+			} else {
+				changed(l, "moved extension", "from", schema, "to", ext.Schema)
+			}
+		}
+	}
+
+	if ext.Version == "" {
+		return errors.Join(errs...)
+	}
+	version, err := processor.ExtensionVersion(ctx, db, ext.Extension)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("could not determine extension version: %w", err))
+		return errors.Join(errs...)
+	}
+	if version == ext.Version {
+		l.Debug("extension already at version")
+		return errors.Join(errs...)
+	}
+	if err := processor.UpdateExtension(ctx, db, ext.Extension, ext.Version); err != nil {
+		errs = append(errs, fmt.Errorf("could not update extension: %w", err))
+	} else {
+		changed(l, "updated extension", "from", version, "to", ext.Version)
+	}
+	return errors.Join(errs...)
+}
+
+// Gets a superuser connection to a specific database in the cluster
+func getDatabaseDb(ctx context.Context, cluster k8s.ClusterResult, database string) (*sql.DB, error) {
+	user := cluster.Superuser
+	user.Database = database
+	return getDb(ctx, user)
+}
+
+// Opens a superuser connection to a database in the cluster that
+// isn't kept in the pool, for databases that other connections get
+// in the way of, e.g. templates can't be copied while connected to.
+// It should be closed once it has been used.
+func openDatabaseDb(ctx context.Context, cluster k8s.ClusterResult, database string) (*sql.DB, error) {
+	user := cluster.Superuser
+	user.Database = database
+	conn, err := sql.Open("pgx", user.Url())
+	if err != nil {
+		return nil, err
+	}
+	conn.SetMaxIdleConns(0)
+	if err := conn.PingContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
 }
 
 func getDb(ctx context.Context, user k8s.ClusterSuperuser) (*sql.DB, error) {
@@ -110,8 +508,46 @@ func getDb(ctx context.Context, user k8s.ClusterSuperuser) (*sql.DB, error) {
 			return nil, err
 		}
 		dbs.Put(user.Key(), conn)
+		poolsMu.Lock()
+		pools = append(pools, conn)
+		poolsMu.Unlock()
 		db = conn
 	}
 
 	return db, nil
 }
+
+// Returns the items in desired that are missing from current, and
+// the items in current that are not in desired
+func diff(desired, current []string) ([]string, []string) {
+	missing := []string{}
+	for _, d := range desired {
+		if !slices.Contains(current, d) && !slices.Contains(missing, d) {
+			missing = append(missing, d)
+		}
+	}
+	extra := []string{}
+	for _, c := range current {
+		if !slices.Contains(desired, c) && !slices.Contains(extra, c) {
+			extra = append(extra, c)
+		}
+	}
+	return missing, extra
+}
+
+func upper(in []string) []string {
+	out := make([]string, len(in))
+	for i, s := range in {
+		out[i] = strings.ToUpper(s)
+	}
+	return out
+}
+
+func sortedKeys[T any](in map[string]T) []string {
+	keys := []string{}
+	for key := range in {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -6,19 +6,119 @@ import (
 	"errors"
 	"fmt"
 	"slices"
+	"strings"
 
+	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
 	"github.com/henrywhitaker3/flow"
 )
 
 type Processor interface {
 	UserExists(context.Context, *sql.DB, string) (bool, error)
 	UserIsOwner(context.Context, *sql.DB, string, string, string) (bool, error)
+	DatabaseOwner(context.Context, *sql.DB, string) (string, error)
+	RoleAttributes(context.Context, *sql.DB, string) (RoleAttributes, error)
+	AlterRole(context.Context, *sql.DB, string, []string) error
+	RoleMemberships(context.Context, *sql.DB, string) ([]string, error)
+	CreateGroupRole(context.Context, *sql.DB, string) error
+	GrantRole(context.Context, *sql.DB, string, string) error
+	RevokeRole(context.Context, *sql.DB, string, string) error
+	RoleSettings(context.Context, *sql.DB, string) (map[string]map[string]string, error)
+	SetRoleSetting(context.Context, *sql.DB, string, string, string, string) error
+	ResetRoleSetting(context.Context, *sql.DB, string, string, string) error
 	DatabaseExists(context.Context, *sql.DB, string, string) (bool, error)
+	IsTemplateDatabase(context.Context, *sql.DB, string) (bool, error)
 	MakeUserOwner(context.Context, *sql.DB, string, string) error
+	CreateDatabase(context.Context, *sql.DB, k8s.DatabaseSpec) error
+	DatabaseOptions(context.Context, *sql.DB, string) (k8s.DatabaseSpec, error)
+	DatabaseSettings(context.Context, *sql.DB, string) (map[string]string, error)
+	SetDatabaseSetting(context.Context, *sql.DB, string, string, string) error
+	ResetDatabaseSetting(context.Context, *sql.DB, string, string) error
+	RecordDatabaseSetting(context.Context, *sql.DB, string, string) error
+	ForgetDatabaseSetting(context.Context, *sql.DB, string, string) error
+	RecordedDatabaseSettings(context.Context, *sql.DB) (map[string][]string, error)
+	ServerVersion(context.Context, *sql.DB) (int, error)
+	AppliedMigrations(context.Context, *sql.DB) (map[string]string, error)
+	ApplyMigration(context.Context, *sql.DB, k8s.Migration) error
+	CronJobs(context.Context, *sql.DB) ([]ScheduledJob, error)
+	ScheduleCronJob(context.Context, *sql.DB, k8s.CronJob) error
+	UnscheduleCronJob(context.Context, *sql.DB, int64) error
+	RecordCronJob(context.Context, *sql.DB, string) error
+	ForgetCronJob(context.Context, *sql.DB, string) error
+	ManagedCronJobs(context.Context, *sql.DB) ([]string, error)
+	ForeignServerOptions(context.Context, *sql.DB, string) (map[string]string, bool, error)
+	CreateForeignServer(context.Context, *sql.DB, string, map[string]string) error
+	AlterForeignServer(context.Context, *sql.DB, string, []string) error
+	UserMappingOptions(context.Context, *sql.DB, string, string) (map[string]string, bool, error)
+	CreateUserMapping(context.Context, *sql.DB, string, string, map[string]string) error
+	AlterUserMapping(context.Context, *sql.DB, string, string, []string) error
+	HasForeignTables(context.Context, *sql.DB, string, string) (bool, error)
+	ImportForeignSchema(context.Context, *sql.DB, string, string, string) error
+	Publication(context.Context, *sql.DB, string) (PublicationState, bool, error)
+	CreatePublication(context.Context, *sql.DB, k8s.Publication) error
+	AddPublicationTables(context.Context, *sql.DB, string, []string) error
+	DropPublicationTables(context.Context, *sql.DB, string, []string) error
+	Subscription(context.Context, *sql.DB, string) (SubscriptionState, bool, error)
+	CreateSubscription(context.Context, *sql.DB, string, string, []string) error
+	SetSubscriptionConnection(context.Context, *sql.DB, string, string) error
+	SetSubscriptionPublications(context.Context, *sql.DB, string, []string) error
+	RefreshSubscription(context.Context, *sql.DB, string) error
+	SubscribedTables(context.Context, *sql.DB, string) ([]string, error)
+	PublishedTables(context.Context, string, []string) ([]string, error)
+	ReplicationSlot(context.Context, *sql.DB, string) (ReplicationSlot, bool, error)
+	CreateReplicationSlot(context.Context, *sql.DB, string, string) error
+	TablesWithoutSelect(context.Context, *sql.DB, string, []string) ([]string, error)
+	GrantSelect(context.Context, *sql.DB, string, []string) error
+	PublicDatabasePrivileges(context.Context, *sql.DB, string) ([]string, error)
+	RevokePublicDatabasePrivileges(context.Context, *sql.DB, string, []string) error
+	PublicCanCreateInPublicSchema(context.Context, *sql.DB) (bool, error)
+	RevokePublicSchemaCreate(context.Context, *sql.DB) error
+	OwnedObjects(context.Context, *sql.DB, string) ([]DatabaseObject, error)
+	ReassignObject(context.Context, *sql.DB, DatabaseObject, string) error
 	ExtensionExists(context.Context, *sql.DB, string) (bool, error)
-	CreateExtension(context.Context, *sql.DB, string, bool) error
+	CreateExtension(context.Context, *sql.DB, string, bool, string, string) error
+	ExtensionVersion(context.Context, *sql.DB, string) (string, error)
+	UpdateExtension(context.Context, *sql.DB, string, string) error
+	ExtensionSchema(context.Context, *sql.DB, string) (string, bool, error)
+	SetExtensionSchema(context.Context, *sql.DB, string, string) error
+	DropExtension(context.Context, *sql.DB, string, bool) error
+	RecordExtension(context.Context, *sql.DB, string, string) error
+	ForgetExtension(context.Context, *sql.DB, string, string) error
+	InstalledExtensions(context.Context, *sql.DB, string) ([]string, error)
+	ExtensionDatabases(context.Context, *sql.DB) ([]string, error)
+	SchemaExists(context.Context, *sql.DB, string) (bool, error)
+	CreateSchema(context.Context, *sql.DB, string, string) error
+	SchemaIsOwner(context.Context, *sql.DB, string, string) (bool, error)
+	MakeSchemaOwner(context.Context, *sql.DB, string, string) error
+	DefaultPrivileges(context.Context, *sql.DB, DefaultPrivilegeTarget) ([]string, error)
+	GrantDefaultPrivileges(context.Context, *sql.DB, DefaultPrivilegeTarget, []string) error
+	RevokeDefaultPrivileges(context.Context, *sql.DB, DefaultPrivilegeTarget, []string) error
+	Privileges(context.Context, *sql.DB, GrantTarget) (Privileges, error)
+	GrantPrivileges(context.Context, *sql.DB, GrantTarget, []string) error
+	RevokePrivileges(context.Context, *sql.DB, GrantTarget, []string) error
+	RecordGrant(context.Context, *sql.DB, string, string, []string) error
+	ForgetGrant(context.Context, *sql.DB, string, string) error
+	RecordedGrants(context.Context, *sql.DB) (map[string]map[string][]string, error)
 }
 
+// Identifies a single set of default privileges, which is the
+// privileges the grantee gets on objects of the given type
+// created by the grantor in the schema
+type DefaultPrivilegeTarget struct {
+	Grantor string
+	Schema  string
+	Grantee string
+	// One of TABLES, SEQUENCES or FUNCTIONS
+	Objects string
+}
+
+var (
+	defaultAclObjectTypes = map[string]string{
+		"TABLES":    "r",
+		"SEQUENCES": "S",
+		"FUNCTIONS": "f",
+	}
+)
+
 var (
 	p            *processor
 	NewProcessor = func() Processor {
@@ -29,7 +129,7 @@ var (
 				databaseOwned:  flow.NewStore[bool](),
 			}
 		}
-		return p
+		return instrumented{p}
 	}
 )
 
@@ -79,6 +179,17 @@ func (p *processor) UserIsOwner(ctx context.Context, db *sql.DB, cluster, user,
 	return true, nil
 }
 
+// Returns the database's current owner. Unlike UserIsOwner this is
+// never cached, so it is right for every user of a shared database
+func (p *processor) DatabaseOwner(ctx context.Context, db *sql.DB, database string) (string, error) {
+	row := db.QueryRowContext(ctx, "SELECT pg_catalog.pg_get_userbyid(datdba) FROM pg_catalog.pg_database WHERE datname = $1", database)
+	var owner string
+	if err := row.Scan(&owner); err != nil {
+		return "", err
+	}
+	return owner, nil
+}
+
 func (p *processor) MakeUserOwner(ctx context.Context, db *sql.DB, database, user string) error {
 	_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER DATABASE \"%s\" OWNER TO \"%s\"", database, user))
 	return err
@@ -101,6 +212,18 @@ func (p *processor) DatabaseExists(ctx context.Context, db *sql.DB, cluster stri
 	return true, nil
 }
 
+func (p *processor) IsTemplateDatabase(ctx context.Context, db *sql.DB, database string) (bool, error) {
+	row := db.QueryRowContext(ctx, "SELECT datistemplate FROM pg_catalog.pg_database WHERE datname = $1", database)
+	var template bool
+	if err := row.Scan(&template); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return template, nil
+}
+
 func (p *processor) ExtensionExists(ctx context.Context, db *sql.DB, name string) (bool, error) {
 	rows, err := db.QueryContext(ctx, "SELECT extname FROM pg_extension;")
 	if err != nil {
@@ -123,11 +246,159 @@ func (p *processor) ExtensionExists(ctx context.Context, db *sql.DB, name string
 	return slices.Contains(enabled, name), nil
 }
 
-func (p *processor) CreateExtension(ctx context.Context, db *sql.DB, name string, cascade bool) error {
+func (p *processor) CreateExtension(ctx context.Context, db *sql.DB, name string, cascade bool, version, schema string) error {
 	query := fmt.Sprintf("CREATE EXTENSION %s", name)
+	if schema != "" {
+		query = fmt.Sprintf("%s SCHEMA \"%s\"", query, schema)
+	}
+	if version != "" {
+		query = fmt.Sprintf("%s VERSION '%s'", query, version)
+	}
 	if cascade {
 		query = fmt.Sprintf("%s CASCADE", query)
 	}
 	_, err := db.ExecContext(ctx, query)
 	return err
 }
+
+func (p *processor) ExtensionVersion(ctx context.Context, db *sql.DB, name string) (string, error) {
+	row := db.QueryRowContext(ctx, "SELECT extversion FROM pg_catalog.pg_extension WHERE extname = $1 LIMIT 1", name)
+	var version string
+	if err := row.Scan(&version); err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+func (p *processor) UpdateExtension(ctx context.Context, db *sql.DB, name, version string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER EXTENSION %s UPDATE TO '%s'", name, version))
+	return err
+}
+
+func (p *processor) ExtensionSchema(ctx context.Context, db *sql.DB, name string) (string, bool, error) {
+	row := db.QueryRowContext(
+		ctx,
+		`SELECT n.nspname, e.extrelocatable
+		FROM pg_catalog.pg_extension e
+		JOIN pg_catalog.pg_namespace n ON n.oid = e.extnamespace
+		WHERE e.extname = $1 LIMIT 1`,
+		name,
+	)
+	var schema string
+	var relocatable bool
+	if err := row.Scan(&schema, &relocatable); err != nil {
+		return "", false, err
+	}
+	return schema, relocatable, nil
+}
+
+func (p *processor) SetExtensionSchema(ctx context.Context, db *sql.DB, name, schema string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER EXTENSION %s SET SCHEMA \"%s\"", name, schema))
+	return err
+}
+
+func (p *processor) SchemaExists(ctx context.Context, db *sql.DB, schema string) (bool, error) {
+	row := db.QueryRowContext(ctx, "SELECT 1 FROM pg_catalog.pg_namespace WHERE nspname = $1 LIMIT 1", schema)
+	var su int
+	if err := row.Scan(&su); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (p *processor) CreateSchema(ctx context.Context, db *sql.DB, schema, authorization string) error {
+	query := fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS \"%s\"", schema)
+	if authorization != "" {
+		query = fmt.Sprintf("%s AUTHORIZATION \"%s\"", query, authorization)
+	}
+	_, err := db.ExecContext(ctx, query)
+	return err
+}
+
+func (p *processor) SchemaIsOwner(ctx context.Context, db *sql.DB, schema, user string) (bool, error) {
+	row := db.QueryRowContext(ctx, "SELECT nspowner::regrole FROM pg_catalog.pg_namespace WHERE nspname = $1 LIMIT 1", schema)
+	var owner string
+	if err := row.Scan(&owner); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return owner == user, nil
+}
+
+func (p *processor) MakeSchemaOwner(ctx context.Context, db *sql.DB, schema, user string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER SCHEMA \"%s\" OWNER TO \"%s\"", schema, user))
+	return err
+}
+
+func (p *processor) DefaultPrivileges(ctx context.Context, db *sql.DB, target DefaultPrivilegeTarget) ([]string, error) {
+	objType, ok := defaultAclObjectTypes[target.Objects]
+	if !ok {
+		return nil, fmt.Errorf("unknown default privilege object type %s", target.Objects)
+	}
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT acl.privilege_type
+		FROM pg_catalog.pg_default_acl d
+		JOIN pg_catalog.pg_roles grantor ON grantor.oid = d.defaclrole
+		LEFT JOIN pg_catalog.pg_namespace n ON n.oid = d.defaclnamespace
+		CROSS JOIN LATERAL aclexplode(d.defaclacl) acl
+		JOIN pg_catalog.pg_roles grantee ON grantee.oid = acl.grantee
+		WHERE grantor.rolname = $1
+			AND COALESCE(n.nspname, '') = $2
+			AND d.defaclobjtype = $3
+			AND grantee.rolname = $4`,
+		target.Grantor,
+		target.Schema,
+		objType,
+		target.Grantee,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	privileges := []string{}
+	for rows.Next() {
+		var privilege string
+		if err := rows.Scan(&privilege); err != nil {
+			return nil, err
+		}
+		privileges = append(privileges, privilege)
+	}
+	return privileges, rows.Err()
+}
+
+func (p *processor) GrantDefaultPrivileges(ctx context.Context, db *sql.DB, target DefaultPrivilegeTarget, privileges []string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"%s GRANT %s ON %s TO \"%s\"",
+		alterDefaultPrivileges(target),
+		strings.Join(privileges, ", "),
+		target.Objects,
+		target.Grantee,
+	))
+	return err
+}
+
+func (p *processor) RevokeDefaultPrivileges(ctx context.Context, db *sql.DB, target DefaultPrivilegeTarget, privileges []string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"%s REVOKE %s ON %s FROM \"%s\"",
+		alterDefaultPrivileges(target),
+		strings.Join(privileges, ", "),
+		target.Objects,
+		target.Grantee,
+	))
+	return err
+}
+
+func alterDefaultPrivileges(target DefaultPrivilegeTarget) string {
+	query := fmt.Sprintf("ALTER DEFAULT PRIVILEGES FOR ROLE \"%s\"", target.Grantor)
+	if target.Schema != "" {
+		query = fmt.Sprintf("%s IN SCHEMA \"%s\"", query, target.Schema)
+	}
+	return query
+}
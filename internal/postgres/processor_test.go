@@ -5,8 +5,12 @@ import (
 	"database/sql"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
+	"github.com/henrywhitaker3/crunchy-users/internal/metrics"
+	"github.com/henrywhitaker3/flow"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/mock"
 )
 
@@ -20,6 +24,25 @@ func testSuperuser() k8s.ClusterSuperuser {
 	}
 }
 
+func testForeignServer() k8s.ForeignServer {
+	return k8s.ForeignServer{
+		Database:       "postgres",
+		Server:         "reporting",
+		Cluster:        "source",
+		User:           "bongo",
+		RemoteDatabase: "bongo",
+		ImportSchema:   "public",
+		IntoSchema:     "source",
+		Credentials: k8s.ClusterSuperuser{
+			Host:     "source-primary.test.svc",
+			Port:     5432,
+			User:     "bongo",
+			Password: "rotated",
+			Database: "bongo",
+		},
+	}
+}
+
 type mockProcessor struct {
 	mock.Mock
 }
@@ -29,31 +52,426 @@ func (m *mockProcessor) UserExists(ctx context.Context, db *sql.DB, name string)
 	return args.Bool(0), args.Error(1)
 }
 
+func (m *mockProcessor) IsTemplateDatabase(ctx context.Context, db *sql.DB, database string) (bool, error) {
+	args := m.Called(ctx, db, database)
+	return args.Bool(0), args.Error(1)
+}
+
 func (m *mockProcessor) UserIsOwner(ctx context.Context, db *sql.DB, cluster, user, database string) (bool, error) {
 	args := m.Called(ctx, db, cluster, user, database)
 	return args.Bool(0), args.Error(1)
 }
 
+func (m *mockProcessor) RoleAttributes(ctx context.Context, db *sql.DB, user string) (RoleAttributes, error) {
+	args := m.Called(ctx, db, user)
+	return args.Get(0).(RoleAttributes), args.Error(1)
+}
+
+func (m *mockProcessor) AlterRole(ctx context.Context, db *sql.DB, user string, options []string) error {
+	args := m.Called(ctx, db, user, options)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) RoleMemberships(ctx context.Context, db *sql.DB, user string) ([]string, error) {
+	args := m.Called(ctx, db, user)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *mockProcessor) CreateGroupRole(ctx context.Context, db *sql.DB, role string) error {
+	args := m.Called(ctx, db, role)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) GrantRole(ctx context.Context, db *sql.DB, role, user string) error {
+	args := m.Called(ctx, db, role, user)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) RevokeRole(ctx context.Context, db *sql.DB, role, user string) error {
+	args := m.Called(ctx, db, role, user)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) RoleSettings(ctx context.Context, db *sql.DB, user string) (map[string]map[string]string, error) {
+	args := m.Called(ctx, db, user)
+	return args.Get(0).(map[string]map[string]string), args.Error(1)
+}
+
+func (m *mockProcessor) SetRoleSetting(ctx context.Context, db *sql.DB, user, database, name, value string) error {
+	args := m.Called(ctx, db, user, database, name, value)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) ResetRoleSetting(ctx context.Context, db *sql.DB, user, database, name string) error {
+	args := m.Called(ctx, db, user, database, name)
+	return args.Error(0)
+}
+
 func (m *mockProcessor) DatabaseExists(ctx context.Context, db *sql.DB, cluster string, database string) (bool, error) {
 	args := m.Called(ctx, db, cluster, database)
 	return args.Bool(0), args.Error(1)
 }
 
+func (m *mockProcessor) DatabaseOwner(ctx context.Context, db *sql.DB, database string) (string, error) {
+	args := m.Called(ctx, db, database)
+	return args.String(0), args.Error(1)
+}
+
 func (m *mockProcessor) MakeUserOwner(ctx context.Context, db *sql.DB, database, user string) error {
 	args := m.Called(ctx, db, database, user)
 	return args.Error(0)
 }
 
+func (m *mockProcessor) CreateDatabase(ctx context.Context, db *sql.DB, spec k8s.DatabaseSpec) error {
+	args := m.Called(ctx, db, spec)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) DatabaseOptions(ctx context.Context, db *sql.DB, database string) (k8s.DatabaseSpec, error) {
+	args := m.Called(ctx, db, database)
+	return args.Get(0).(k8s.DatabaseSpec), args.Error(1)
+}
+
+func (m *mockProcessor) DatabaseSettings(ctx context.Context, db *sql.DB, database string) (map[string]string, error) {
+	args := m.Called(ctx, db, database)
+	return args.Get(0).(map[string]string), args.Error(1)
+}
+
+func (m *mockProcessor) SetDatabaseSetting(ctx context.Context, db *sql.DB, database, name, value string) error {
+	args := m.Called(ctx, db, database, name, value)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) ResetDatabaseSetting(ctx context.Context, db *sql.DB, database, name string) error {
+	args := m.Called(ctx, db, database, name)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) ServerVersion(ctx context.Context, db *sql.DB) (int, error) {
+	args := m.Called(ctx, db)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *mockProcessor) PublicDatabasePrivileges(ctx context.Context, db *sql.DB, database string) ([]string, error) {
+	args := m.Called(ctx, db, database)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *mockProcessor) RevokePublicDatabasePrivileges(ctx context.Context, db *sql.DB, database string, privileges []string) error {
+	args := m.Called(ctx, db, database, privileges)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) PublicCanCreateInPublicSchema(ctx context.Context, db *sql.DB) (bool, error) {
+	args := m.Called(ctx, db)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *mockProcessor) RevokePublicSchemaCreate(ctx context.Context, db *sql.DB) error {
+	args := m.Called(ctx, db)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) OwnedObjects(ctx context.Context, db *sql.DB, owner string) ([]DatabaseObject, error) {
+	args := m.Called(ctx, db, owner)
+	return args.Get(0).([]DatabaseObject), args.Error(1)
+}
+
+func (m *mockProcessor) ReassignObject(ctx context.Context, db *sql.DB, obj DatabaseObject, owner string) error {
+	args := m.Called(ctx, db, obj, owner)
+	return args.Error(0)
+}
+
 func (m *mockProcessor) ExtensionExists(ctx context.Context, db *sql.DB, name string) (bool, error) {
 	args := m.Called(ctx, db, name)
 	return args.Bool(0), args.Error(1)
 }
 
-func (m *mockProcessor) CreateExtension(ctx context.Context, db *sql.DB, name string, cascade bool) error {
+func (m *mockProcessor) CreateExtension(ctx context.Context, db *sql.DB, name string, cascade bool, version, schema string) error {
+	args := m.Called(ctx, db, name, cascade, version, schema)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) ExtensionSchema(ctx context.Context, db *sql.DB, name string) (string, bool, error) {
+	args := m.Called(ctx, db, name)
+	return args.String(0), args.Bool(1), args.Error(2)
+}
+
+func (m *mockProcessor) SetExtensionSchema(ctx context.Context, db *sql.DB, name, schema string) error {
+	args := m.Called(ctx, db, name, schema)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) ExtensionVersion(ctx context.Context, db *sql.DB, name string) (string, error) {
+	args := m.Called(ctx, db, name)
+	return args.String(0), args.Error(1)
+}
+
+func (m *mockProcessor) UpdateExtension(ctx context.Context, db *sql.DB, name, version string) error {
+	args := m.Called(ctx, db, name, version)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) DropExtension(ctx context.Context, db *sql.DB, name string, cascade bool) error {
 	args := m.Called(ctx, db, name, cascade)
 	return args.Error(0)
 }
 
+func (m *mockProcessor) RecordExtension(ctx context.Context, db *sql.DB, database, name string) error {
+	args := m.Called(ctx, db, database, name)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) ForgetExtension(ctx context.Context, db *sql.DB, database, name string) error {
+	args := m.Called(ctx, db, database, name)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) ExtensionDatabases(ctx context.Context, db *sql.DB) ([]string, error) {
+	args := m.Called(ctx, db)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *mockProcessor) InstalledExtensions(ctx context.Context, db *sql.DB, database string) ([]string, error) {
+	args := m.Called(ctx, db, database)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *mockProcessor) SchemaExists(ctx context.Context, db *sql.DB, schema string) (bool, error) {
+	args := m.Called(ctx, db, schema)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *mockProcessor) CreateSchema(ctx context.Context, db *sql.DB, schema, authorization string) error {
+	args := m.Called(ctx, db, schema, authorization)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) SchemaIsOwner(ctx context.Context, db *sql.DB, schema, user string) (bool, error) {
+	args := m.Called(ctx, db, schema, user)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *mockProcessor) MakeSchemaOwner(ctx context.Context, db *sql.DB, schema, user string) error {
+	args := m.Called(ctx, db, schema, user)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) DefaultPrivileges(ctx context.Context, db *sql.DB, target DefaultPrivilegeTarget) ([]string, error) {
+	args := m.Called(ctx, db, target)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *mockProcessor) GrantDefaultPrivileges(ctx context.Context, db *sql.DB, target DefaultPrivilegeTarget, privileges []string) error {
+	args := m.Called(ctx, db, target, privileges)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) RevokeDefaultPrivileges(ctx context.Context, db *sql.DB, target DefaultPrivilegeTarget, privileges []string) error {
+	args := m.Called(ctx, db, target, privileges)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) Privileges(ctx context.Context, db *sql.DB, target GrantTarget) (Privileges, error) {
+	args := m.Called(ctx, db, target)
+	return args.Get(0).(Privileges), args.Error(1)
+}
+
+func (m *mockProcessor) GrantPrivileges(ctx context.Context, db *sql.DB, target GrantTarget, privileges []string) error {
+	args := m.Called(ctx, db, target, privileges)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) RevokePrivileges(ctx context.Context, db *sql.DB, target GrantTarget, privileges []string) error {
+	args := m.Called(ctx, db, target, privileges)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) RecordGrant(ctx context.Context, db *sql.DB, database, user string, schemas []string) error {
+	args := m.Called(ctx, db, database, user, schemas)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) ForgetGrant(ctx context.Context, db *sql.DB, database, user string) error {
+	args := m.Called(ctx, db, database, user)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) RecordedGrants(ctx context.Context, db *sql.DB) (map[string]map[string][]string, error) {
+	args := m.Called(ctx, db)
+	return args.Get(0).(map[string]map[string][]string), args.Error(1)
+}
+
+func (m *mockProcessor) RecordDatabaseSetting(ctx context.Context, db *sql.DB, database, name string) error {
+	args := m.Called(ctx, db, database, name)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) ForgetDatabaseSetting(ctx context.Context, db *sql.DB, database, name string) error {
+	args := m.Called(ctx, db, database, name)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) RecordedDatabaseSettings(ctx context.Context, db *sql.DB) (map[string][]string, error) {
+	args := m.Called(ctx, db)
+	return args.Get(0).(map[string][]string), args.Error(1)
+}
+
+func (m *mockProcessor) AppliedMigrations(ctx context.Context, db *sql.DB) (map[string]string, error) {
+	args := m.Called(ctx, db)
+	return args.Get(0).(map[string]string), args.Error(1)
+}
+
+func (m *mockProcessor) ApplyMigration(ctx context.Context, db *sql.DB, migration k8s.Migration) error {
+	args := m.Called(ctx, db, migration)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) CronJobs(ctx context.Context, db *sql.DB) ([]ScheduledJob, error) {
+	args := m.Called(ctx, db)
+	return args.Get(0).([]ScheduledJob), args.Error(1)
+}
+
+func (m *mockProcessor) ScheduleCronJob(ctx context.Context, db *sql.DB, job k8s.CronJob) error {
+	args := m.Called(ctx, db, job)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) UnscheduleCronJob(ctx context.Context, db *sql.DB, id int64) error {
+	args := m.Called(ctx, db, id)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) RecordCronJob(ctx context.Context, db *sql.DB, name string) error {
+	args := m.Called(ctx, db, name)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) ForgetCronJob(ctx context.Context, db *sql.DB, name string) error {
+	args := m.Called(ctx, db, name)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) ManagedCronJobs(ctx context.Context, db *sql.DB) ([]string, error) {
+	args := m.Called(ctx, db)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *mockProcessor) ForeignServerOptions(ctx context.Context, db *sql.DB, server string) (map[string]string, bool, error) {
+	args := m.Called(ctx, db, server)
+	return args.Get(0).(map[string]string), args.Bool(1), args.Error(2)
+}
+
+func (m *mockProcessor) CreateForeignServer(ctx context.Context, db *sql.DB, server string, options map[string]string) error {
+	args := m.Called(ctx, db, server, options)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) AlterForeignServer(ctx context.Context, db *sql.DB, server string, options []string) error {
+	args := m.Called(ctx, db, server, options)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) UserMappingOptions(ctx context.Context, db *sql.DB, server, user string) (map[string]string, bool, error) {
+	args := m.Called(ctx, db, server, user)
+	return args.Get(0).(map[string]string), args.Bool(1), args.Error(2)
+}
+
+func (m *mockProcessor) CreateUserMapping(ctx context.Context, db *sql.DB, server, user string, options map[string]string) error {
+	args := m.Called(ctx, db, server, user, options)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) AlterUserMapping(ctx context.Context, db *sql.DB, server, user string, options []string) error {
+	args := m.Called(ctx, db, server, user, options)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) HasForeignTables(ctx context.Context, db *sql.DB, server, schema string) (bool, error) {
+	args := m.Called(ctx, db, server, schema)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *mockProcessor) ImportForeignSchema(ctx context.Context, db *sql.DB, server, remote, local string) error {
+	args := m.Called(ctx, db, server, remote, local)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) Publication(ctx context.Context, db *sql.DB, publication string) (PublicationState, bool, error) {
+	args := m.Called(ctx, db, publication)
+	return args.Get(0).(PublicationState), args.Bool(1), args.Error(2)
+}
+
+func (m *mockProcessor) CreatePublication(ctx context.Context, db *sql.DB, publication k8s.Publication) error {
+	args := m.Called(ctx, db, publication)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) AddPublicationTables(ctx context.Context, db *sql.DB, publication string, tables []string) error {
+	args := m.Called(ctx, db, publication, tables)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) DropPublicationTables(ctx context.Context, db *sql.DB, publication string, tables []string) error {
+	args := m.Called(ctx, db, publication, tables)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) Subscription(ctx context.Context, db *sql.DB, subscription string) (SubscriptionState, bool, error) {
+	args := m.Called(ctx, db, subscription)
+	return args.Get(0).(SubscriptionState), args.Bool(1), args.Error(2)
+}
+
+func (m *mockProcessor) CreateSubscription(ctx context.Context, db *sql.DB, subscription, conninfo string, publications []string) error {
+	args := m.Called(ctx, db, subscription, conninfo, publications)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) SetSubscriptionConnection(ctx context.Context, db *sql.DB, subscription, conninfo string) error {
+	args := m.Called(ctx, db, subscription, conninfo)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) SetSubscriptionPublications(ctx context.Context, db *sql.DB, subscription string, publications []string) error {
+	args := m.Called(ctx, db, subscription, publications)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) RefreshSubscription(ctx context.Context, db *sql.DB, subscription string) error {
+	args := m.Called(ctx, db, subscription)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) SubscribedTables(ctx context.Context, db *sql.DB, subscription string) ([]string, error) {
+	args := m.Called(ctx, db, subscription)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *mockProcessor) PublishedTables(ctx context.Context, conninfo string, publications []string) ([]string, error) {
+	args := m.Called(ctx, conninfo, publications)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *mockProcessor) ReplicationSlot(ctx context.Context, db *sql.DB, slot string) (ReplicationSlot, bool, error) {
+	args := m.Called(ctx, db, slot)
+	return args.Get(0).(ReplicationSlot), args.Bool(1), args.Error(2)
+}
+
+func (m *mockProcessor) CreateReplicationSlot(ctx context.Context, db *sql.DB, slot, plugin string) error {
+	args := m.Called(ctx, db, slot, plugin)
+	return args.Error(0)
+}
+
+func (m *mockProcessor) TablesWithoutSelect(ctx context.Context, db *sql.DB, user string, tables []string) ([]string, error) {
+	args := m.Called(ctx, db, user, tables)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *mockProcessor) GrantSelect(ctx context.Context, db *sql.DB, user string, tables []string) error {
+	args := m.Called(ctx, db, user, tables)
+	return args.Error(0)
+}
+
 func setMockProcessor(p Processor) {
 	NewProcessor = func() Processor {
 		return p
@@ -65,6 +483,8 @@ func TestItStopsWhenUserDoesNotExistAndNoError(t *testing.T) {
 	setMockProcessor(m)
 
 	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(false, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
 
 	HandleCluster(context.Background(), k8s.ClusterResult{
 		Name:      "test",
@@ -90,6 +510,8 @@ func TestItStopsWhenUserDoesNotExistAndError(t *testing.T) {
 	setMockProcessor(m)
 
 	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, errors.New("bongo"))
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
 
 	HandleCluster(context.Background(), k8s.ClusterResult{
 		Name:      "test",
@@ -116,6 +538,8 @@ func TestItChecksAndStopsDatabaseExistsWhenUserExistsNoError(t *testing.T) {
 
 	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
 	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(false, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
 
 	HandleCluster(context.Background(), k8s.ClusterResult{
 		Name:      "test",
@@ -141,6 +565,8 @@ func TestItChecksAndStopsDatabaseExistsWhenUserExistsError(t *testing.T) {
 
 	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
 	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(true, errors.New("bongo"))
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
 
 	HandleCluster(context.Background(), k8s.ClusterResult{
 		Name:      "test",
@@ -167,6 +593,8 @@ func TestItChecksAndStopsWhenUserIsOwnerForSingleDatabasesNoErrors(t *testing.T)
 	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
 	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(true, nil)
 	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "bongo").Return(true, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
 
 	HandleCluster(context.Background(), k8s.ClusterResult{
 		Name:      "test",
@@ -192,6 +620,8 @@ func TestItChecksAndStopsWhenUserIsOwnerForSingleDatabasesWithErrors(t *testing.
 	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
 	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(true, nil)
 	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "bongo").Return(false, errors.New("bongo"))
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
 
 	HandleCluster(context.Background(), k8s.ClusterResult{
 		Name:      "test",
@@ -218,6 +648,8 @@ func TestItMakesTheUserTheOwnerNoErrors(t *testing.T) {
 	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(true, nil)
 	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "bongo").Return(false, nil)
 	m.On("MakeUserOwner", mock.Anything, mock.Anything, "bongo", "bongo").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
 
 	HandleCluster(context.Background(), k8s.ClusterResult{
 		Name:      "test",
@@ -246,6 +678,8 @@ func TestItMakesUserOwnerOfMultipleDatabases(t *testing.T) {
 	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "bingo").Return(false, nil)
 	m.On("MakeUserOwner", mock.Anything, mock.Anything, "bongo", "bongo").Return(nil)
 	m.On("MakeUserOwner", mock.Anything, mock.Anything, "bingo", "bongo").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
 
 	HandleCluster(context.Background(), k8s.ClusterResult{
 		Name:      "test",
@@ -273,7 +707,10 @@ func TestItDoesntCreateExtensionsWhenTheyExist(t *testing.T) {
 	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
 	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(true, nil)
 	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "bongo").Return(true, nil)
+	m.On("IsTemplateDatabase", mock.Anything, mock.Anything, mock.Anything).Return(false, nil)
 	m.On("ExtensionExists", mock.Anything, mock.Anything, "vector").Return(true, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
 
 	HandleCluster(context.Background(), k8s.ClusterResult{
 		Name:      "test",
@@ -306,8 +743,12 @@ func TestItCreatesExtensionsWhenTheyDontExist(t *testing.T) {
 	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
 	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(true, nil)
 	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "bongo").Return(true, nil)
+	m.On("IsTemplateDatabase", mock.Anything, mock.Anything, mock.Anything).Return(false, nil)
 	m.On("ExtensionExists", mock.Anything, mock.Anything, "vector").Return(false, nil)
-	m.On("CreateExtension", mock.Anything, mock.Anything, "vector", true).Return(nil)
+	m.On("CreateExtension", mock.Anything, mock.Anything, "vector", true, "", "").Return(nil)
+	m.On("RecordExtension", mock.Anything, mock.Anything, "bongo", "vector").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
 
 	HandleCluster(context.Background(), k8s.ClusterResult{
 		Name:      "test",
@@ -330,3 +771,1910 @@ func TestItCreatesExtensionsWhenTheyDontExist(t *testing.T) {
 		},
 	})
 }
+
+func TestItCreatesSchemasWhenTheyDontExist(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "postgres").Return(true, nil)
+	m.On("SchemaExists", mock.Anything, mock.Anything, "app").Return(false, nil)
+	m.On("CreateSchema", mock.Anything, mock.Anything, "app", "bongo").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name:      "bongo",
+				Databases: []string{"postgres"},
+			},
+		},
+		Schemas: map[string][]k8s.DatabaseSchema{
+			"postgres": {
+				{
+					Database:      "postgres",
+					Schema:        "app",
+					Authorization: "bongo",
+				},
+			},
+		},
+	})
+
+	m.AssertNumberOfCalls(t, "CreateSchema", 1)
+	m.AssertNotCalled(t, "SchemaIsOwner")
+	m.AssertNotCalled(t, "MakeSchemaOwner")
+}
+
+func TestItFixesSchemaOwnerWhenItHasDrifted(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "postgres").Return(true, nil)
+	m.On("SchemaExists", mock.Anything, mock.Anything, "app").Return(true, nil)
+	m.On("SchemaIsOwner", mock.Anything, mock.Anything, "app", "bingo").Return(false, nil)
+	m.On("MakeSchemaOwner", mock.Anything, mock.Anything, "app", "bingo").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name:      "bongo",
+				Databases: []string{"postgres"},
+			},
+		},
+		Schemas: map[string][]k8s.DatabaseSchema{
+			"postgres": {
+				{
+					Database:      "postgres",
+					Schema:        "app",
+					Owner:         "bingo",
+					Authorization: "bongo",
+				},
+			},
+		},
+	})
+
+	m.AssertNotCalled(t, "CreateSchema")
+	m.AssertNumberOfCalls(t, "MakeSchemaOwner", 1)
+}
+
+func TestItReconcilesDefaultPrivileges(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	tables := DefaultPrivilegeTarget{Grantor: "bongo", Schema: "public", Grantee: "bingo", Objects: "TABLES"}
+	sequences := DefaultPrivilegeTarget{Grantor: "bongo", Schema: "public", Grantee: "bingo", Objects: "SEQUENCES"}
+	functions := DefaultPrivilegeTarget{Grantor: "bongo", Schema: "public", Grantee: "bingo", Objects: "FUNCTIONS"}
+
+	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "postgres").Return(true, nil)
+	m.On("DefaultPrivileges", mock.Anything, mock.Anything, tables).Return([]string{"SELECT", "DELETE"}, nil)
+	m.On("DefaultPrivileges", mock.Anything, mock.Anything, sequences).Return([]string{"USAGE"}, nil)
+	m.On("DefaultPrivileges", mock.Anything, mock.Anything, functions).Return([]string{}, nil)
+	m.On("GrantDefaultPrivileges", mock.Anything, mock.Anything, tables, []string{"INSERT"}).Return(nil)
+	m.On("RevokeDefaultPrivileges", mock.Anything, mock.Anything, tables, []string{"DELETE"}).Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name:      "bongo",
+				Databases: []string{"postgres"},
+			},
+		},
+		DefaultPrivileges: map[string][]k8s.DefaultPrivilege{
+			"postgres": {
+				{
+					Database:  "postgres",
+					Schema:    "public",
+					Grantor:   "bongo",
+					Grantee:   "bingo",
+					Tables:    []string{"select", "insert"},
+					Sequences: []string{"usage"},
+				},
+			},
+		},
+	})
+
+	m.AssertNumberOfCalls(t, "GrantDefaultPrivileges", 1)
+	m.AssertNumberOfCalls(t, "RevokeDefaultPrivileges", 1)
+}
+
+func TestItGrantsAccessForTheDeclaredLevel(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	database := GrantTarget{User: "bingo", Database: "postgres", Objects: GrantDatabase}
+	schema := GrantTarget{User: "bingo", Database: "postgres", Schema: "public", Objects: GrantSchema}
+	tables := GrantTarget{User: "bingo", Database: "postgres", Schema: "public", Objects: GrantTables}
+	sequences := GrantTarget{User: "bingo", Database: "postgres", Schema: "public", Objects: GrantSequences}
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserExists", mock.Anything, mock.Anything, "bingo").Return(true, nil)
+	m.On("Privileges", mock.Anything, mock.Anything, database).Return(Privileges{All: []string{"CONNECT"}, Any: []string{"CONNECT"}}, nil)
+	m.On("Privileges", mock.Anything, mock.Anything, schema).Return(Privileges{All: []string{}, Any: []string{}}, nil)
+	m.On("Privileges", mock.Anything, mock.Anything, tables).Return(Privileges{All: []string{"INSERT"}, Any: []string{"SELECT", "INSERT"}}, nil)
+	m.On("Privileges", mock.Anything, mock.Anything, sequences).Return(Privileges{All: []string{"SELECT"}, Any: []string{"SELECT"}}, nil)
+	m.On("GrantPrivileges", mock.Anything, mock.Anything, schema, []string{"USAGE"}).Return(nil)
+	m.On("GrantPrivileges", mock.Anything, mock.Anything, tables, []string{"SELECT"}).Return(nil)
+	m.On("RevokePrivileges", mock.Anything, mock.Anything, tables, []string{"INSERT"}).Return(nil)
+	m.On("RecordGrant", mock.Anything, mock.Anything, "postgres", "bingo", []string{"public"}).Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Grants: map[string][]k8s.DatabaseGrant{
+			"postgres": {
+				{
+					Database: "postgres",
+					User:     "bingo",
+					Level:    "read",
+				},
+			},
+		},
+	})
+
+	m.AssertNumberOfCalls(t, "GrantPrivileges", 2)
+	m.AssertNumberOfCalls(t, "RevokePrivileges", 1)
+}
+
+func TestItRevokesAccessForUsersNoLongerDeclaredOnADatabase(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	database := GrantTarget{User: "bingo", Database: "postgres", Objects: GrantDatabase}
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(false, nil)
+	m.On("UserExists", mock.Anything, mock.Anything, mock.Anything).Return(true, nil)
+	m.On("Privileges", mock.Anything, mock.Anything, database).Return(Privileges{All: []string{"CONNECT"}, Any: []string{"CONNECT"}}, nil)
+	m.On("Privileges", mock.Anything, mock.Anything, mock.Anything).Return(Privileges{All: []string{}, Any: []string{}}, nil)
+	m.On("RevokePrivileges", mock.Anything, mock.Anything, database, []string{"CONNECT"}).Return(nil)
+	m.On("ForgetGrant", mock.Anything, mock.Anything, "postgres", "bingo").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{
+		"postgres": {"bingo": {}},
+	}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Grants: map[string][]k8s.DatabaseGrant{
+			"postgres": {
+				{
+					Database: "postgres",
+					User:     "bongo",
+					Level:    "none",
+				},
+			},
+			"bongo": {
+				{
+					Database: "bongo",
+					User:     "bingo",
+					Level:    "connect",
+				},
+			},
+		},
+	})
+
+	m.AssertNotCalled(t, "GrantPrivileges")
+	m.AssertNumberOfCalls(t, "RevokePrivileges", 1)
+	m.AssertNumberOfCalls(t, "ForgetGrant", 1)
+}
+
+func TestItDoesntRevokeAccessItDidntGrant(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	connect := GrantTarget{User: "bongo", Database: "postgres", Objects: GrantDatabase}
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(false, nil)
+	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("Privileges", mock.Anything, mock.Anything, connect).Return(Privileges{All: []string{"CONNECT"}, Any: []string{"CONNECT"}}, nil)
+	m.On("Privileges", mock.Anything, mock.Anything, mock.Anything).Return(Privileges{Empty: true}, nil)
+	m.On("RecordGrant", mock.Anything, mock.Anything, "postgres", "bongo", []string{"public"}).Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Grants: map[string][]k8s.DatabaseGrant{
+			"postgres": {
+				{
+					Database: "postgres",
+					User:     "bongo",
+					Level:    "connect",
+				},
+			},
+			"bongo": {
+				{
+					Database: "bongo",
+					User:     "bingo",
+					Level:    "connect",
+				},
+			},
+		},
+	})
+
+	// bingo has a grant on another database, but was never granted
+	// anything on postgres
+	m.AssertNotCalled(t, "UserExists", mock.Anything, mock.Anything, "bingo")
+	m.AssertNotCalled(t, "RevokePrivileges")
+}
+
+func TestItUpdatesExtensionsWhenTheVersionHasDrifted(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "postgres").Return(true, nil)
+	m.On("IsTemplateDatabase", mock.Anything, mock.Anything, mock.Anything).Return(false, nil)
+	m.On("ExtensionExists", mock.Anything, mock.Anything, "vector").Return(true, nil)
+	m.On("ExtensionVersion", mock.Anything, mock.Anything, "vector").Return("0.7.0", nil)
+	m.On("UpdateExtension", mock.Anything, mock.Anything, "vector", "0.8.0").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name:      "bongo",
+				Databases: []string{"postgres"},
+			},
+		},
+		Extensions: map[string][]k8s.DatabaseExtension{
+			"postgres": {
+				{
+					Database:  "postgres",
+					Extension: "vector",
+					Version:   "0.8.0",
+				},
+			},
+		},
+	})
+
+	m.AssertNotCalled(t, "CreateExtension")
+	m.AssertNumberOfCalls(t, "UpdateExtension", 1)
+}
+
+func TestItDoesntUpdateExtensionsAlreadyAtTheVersion(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "postgres").Return(true, nil)
+	m.On("IsTemplateDatabase", mock.Anything, mock.Anything, mock.Anything).Return(false, nil)
+	m.On("ExtensionExists", mock.Anything, mock.Anything, "vector").Return(true, nil)
+	m.On("ExtensionVersion", mock.Anything, mock.Anything, "vector").Return("0.8.0", nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name:      "bongo",
+				Databases: []string{"postgres"},
+			},
+		},
+		Extensions: map[string][]k8s.DatabaseExtension{
+			"postgres": {
+				{
+					Database:  "postgres",
+					Extension: "vector",
+					Version:   "0.8.0",
+				},
+			},
+		},
+	})
+
+	m.AssertNotCalled(t, "CreateExtension")
+	m.AssertNotCalled(t, "UpdateExtension")
+}
+
+func TestItPrunesExtensionsItInstalledThatAreNoLongerDeclared(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "postgres").Return(true, nil)
+	m.On("IsTemplateDatabase", mock.Anything, mock.Anything, mock.Anything).Return(false, nil)
+	m.On("ExtensionExists", mock.Anything, mock.Anything, "vector").Return(true, nil)
+	m.On("InstalledExtensions", mock.Anything, mock.Anything, "postgres").Return([]string{"postgis", "vector"}, nil)
+	m.On("ExtensionDatabases", mock.Anything, mock.Anything).Return([]string{"postgres"}, nil)
+	m.On("DropExtension", mock.Anything, mock.Anything, "postgis", false).Return(nil)
+	m.On("ForgetExtension", mock.Anything, mock.Anything, "postgres", "postgis").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name:      "bongo",
+				Databases: []string{"postgres"},
+			},
+		},
+		Extensions: map[string][]k8s.DatabaseExtension{
+			"postgres": {
+				{
+					Database:  "postgres",
+					Extension: "vector",
+				},
+			},
+		},
+		PruneExtensions: true,
+	})
+
+	m.AssertNumberOfCalls(t, "DropExtension", 1)
+	m.AssertNumberOfCalls(t, "ForgetExtension", 1)
+}
+
+func TestItDoesntPruneExtensionsWhenNotEnabled(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "bongo").Return(true, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name:      "bongo",
+				Databases: []string{"bongo"},
+			},
+		},
+	})
+
+	m.AssertNotCalled(t, "InstalledExtensions")
+	m.AssertNotCalled(t, "DropExtension")
+}
+
+func TestItKeepsPruningWhenAnExtensionCantBeDropped(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("ExtensionDatabases", mock.Anything, mock.Anything).Return([]string{"postgres"}, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("IsTemplateDatabase", mock.Anything, mock.Anything, mock.Anything).Return(false, nil)
+	m.On("InstalledExtensions", mock.Anything, mock.Anything, "postgres").Return([]string{"postgis", "vector"}, nil)
+	m.On("DropExtension", mock.Anything, mock.Anything, "postgis", false).Return(errors.New("extension is in use"))
+	m.On("DropExtension", mock.Anything, mock.Anything, "vector", false).Return(nil)
+	m.On("ForgetExtension", mock.Anything, mock.Anything, "postgres", "vector").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:            "test",
+		Namespace:       "test",
+		Superuser:       testSuperuser(),
+		PruneExtensions: true,
+	})
+
+	m.AssertNumberOfCalls(t, "DropExtension", 2)
+	m.AssertNotCalled(t, "ForgetExtension", mock.Anything, mock.Anything, "postgres", "postgis")
+	m.AssertCalled(t, "ForgetExtension", mock.Anything, mock.Anything, "postgres", "vector")
+}
+
+func TestItMovesRelocatableExtensionsToTheDeclaredSchema(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "postgres").Return(true, nil)
+	m.On("IsTemplateDatabase", mock.Anything, mock.Anything, mock.Anything).Return(false, nil)
+	m.On("ExtensionExists", mock.Anything, mock.Anything, "vector").Return(true, nil)
+	m.On("ExtensionSchema", mock.Anything, mock.Anything, "vector").Return("public", true, nil)
+	m.On("SetExtensionSchema", mock.Anything, mock.Anything, "vector", "extensions").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name:      "bongo",
+				Databases: []string{"postgres"},
+			},
+		},
+		Extensions: map[string][]k8s.DatabaseExtension{
+			"postgres": {
+				{
+					Database:  "postgres",
+					Extension: "vector",
+					Schema:    "extensions",
+				},
+			},
+		},
+	})
+
+	m.AssertNumberOfCalls(t, "SetExtensionSchema", 1)
+}
+
+func TestItDoesntMoveExtensionsThatArentRelocatable(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "postgres").Return(true, nil)
+	m.On("IsTemplateDatabase", mock.Anything, mock.Anything, mock.Anything).Return(false, nil)
+	m.On("ExtensionExists", mock.Anything, mock.Anything, "postgis").Return(true, nil)
+	m.On("ExtensionSchema", mock.Anything, mock.Anything, "postgis").Return("public", false, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name:      "bongo",
+				Databases: []string{"postgres"},
+			},
+		},
+		Extensions: map[string][]k8s.DatabaseExtension{
+			"postgres": {
+				{
+					Database:  "postgres",
+					Extension: "postgis",
+					Schema:    "extensions",
+				},
+			},
+		},
+	})
+
+	m.AssertNotCalled(t, "SetExtensionSchema")
+}
+
+func TestItUpdatesRoleAttributesThatHaveDrifted(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	limit := 10
+	bypass := true
+	createdb := false
+
+	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("RoleAttributes", mock.Anything, mock.Anything, "bongo").Return(RoleAttributes{
+		ConnectionLimit: -1,
+		CreateDB:        false,
+	}, nil)
+	m.On("AlterRole", mock.Anything, mock.Anything, "bongo", []string{"BYPASSRLS", "CONNECTION LIMIT 10"}).Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name: "bongo",
+			},
+		},
+		Roles: map[string]k8s.RoleAttributes{
+			"bongo": {
+				User:            "bongo",
+				ConnectionLimit: &limit,
+				BypassRLS:       &bypass,
+				CreateDB:        &createdb,
+			},
+		},
+	})
+
+	m.AssertNumberOfCalls(t, "AlterRole", 1)
+}
+
+func TestItDoesntAlterRolesThatMatch(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	limit := 10
+	until := "2030-01-01T00:00:00Z"
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("RoleAttributes", mock.Anything, mock.Anything, "bongo").Return(RoleAttributes{
+		ConnectionLimit: 10,
+		ValidUntil:      &expires,
+	}, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name: "bongo",
+			},
+		},
+		Roles: map[string]k8s.RoleAttributes{
+			"bongo": {
+				User:            "bongo",
+				ConnectionLimit: &limit,
+				ValidUntil:      &until,
+			},
+		},
+	})
+
+	m.AssertNotCalled(t, "AlterRole")
+}
+
+func TestItReconcilesRoleMemberships(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("UserExists", mock.Anything, mock.Anything, "readers").Return(false, nil)
+	m.On("RoleMemberships", mock.Anything, mock.Anything, "bongo").Return([]string{"pg_signal_backend"}, nil)
+	m.On("CreateGroupRole", mock.Anything, mock.Anything, "readers").Return(nil)
+	m.On("GrantRole", mock.Anything, mock.Anything, "pg_monitor", "bongo").Return(nil)
+	m.On("GrantRole", mock.Anything, mock.Anything, "readers", "bongo").Return(nil)
+	m.On("RevokeRole", mock.Anything, mock.Anything, "pg_signal_backend", "bongo").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name: "bongo",
+			},
+		},
+		Memberships: map[string]k8s.RoleMembership{
+			"bongo": {
+				User:  "bongo",
+				Roles: []string{"pg_monitor", "readers"},
+			},
+		},
+	})
+
+	m.AssertNumberOfCalls(t, "CreateGroupRole", 1)
+	m.AssertNumberOfCalls(t, "GrantRole", 2)
+	m.AssertNumberOfCalls(t, "RevokeRole", 1)
+}
+
+func TestItReconcilesDatabaseSettings(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("DatabaseSettings", mock.Anything, mock.Anything, "bongo").Return(map[string]string{
+		"search_path":       "app, public",
+		"statement_timeout": "10s",
+		"timezone":          "UTC",
+		"work_mem":          "64MB",
+	}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{
+		"bongo": {"search_path", "work_mem"},
+	}, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("SetDatabaseSetting", mock.Anything, mock.Anything, "bongo", "statement_timeout", "30s").Return(nil)
+	m.On("RecordDatabaseSetting", mock.Anything, mock.Anything, "bongo", "statement_timeout").Return(nil)
+	m.On("ResetDatabaseSetting", mock.Anything, mock.Anything, "bongo", "work_mem").Return(nil)
+	m.On("ForgetDatabaseSetting", mock.Anything, mock.Anything, "bongo", "work_mem").Return(nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		DatabaseSettings: map[string]k8s.DatabaseSettings{
+			"bongo": {
+				Database: "bongo",
+				Settings: map[string]string{
+					"search_path":       "app,public",
+					"statement_timeout": "30s",
+				},
+			},
+		},
+	})
+
+	m.AssertNumberOfCalls(t, "SetDatabaseSetting", 1)
+	m.AssertNumberOfCalls(t, "RecordDatabaseSetting", 1)
+	// timezone wasn't set by crunchy-users, so it is left alone
+	m.AssertNumberOfCalls(t, "ResetDatabaseSetting", 1)
+	m.AssertNumberOfCalls(t, "ForgetDatabaseSetting", 1)
+}
+
+func TestItReconcilesRoleSettings(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("RoleSettings", mock.Anything, mock.Anything, "bongo").Return(map[string]map[string]string{
+		"": {
+			"lock_timeout": "5s",
+		},
+		"bingo": {
+			"search_path": "bingo",
+		},
+	}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("SetRoleSetting", mock.Anything, mock.Anything, "bongo", "", "lock_timeout", "10s").Return(nil)
+	m.On("SetRoleSetting", mock.Anything, mock.Anything, "bongo", "bongo", "search_path", "app, public").Return(nil)
+	m.On("ResetRoleSetting", mock.Anything, mock.Anything, "bongo", "bingo", "search_path").Return(nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name: "bongo",
+			},
+		},
+		RoleSettings: map[string][]k8s.RoleSettings{
+			"bongo": {
+				{
+					User: "bongo",
+					Settings: map[string]string{
+						"lock_timeout": "10s",
+					},
+				},
+				{
+					User:     "bongo",
+					Database: "bongo",
+					Settings: map[string]string{
+						"search_path": "app, public",
+					},
+				},
+			},
+		},
+	})
+
+	m.AssertNumberOfCalls(t, "SetRoleSetting", 2)
+	m.AssertNumberOfCalls(t, "ResetRoleSetting", 1)
+}
+
+func TestItReassignsSuperuserObjectsToTheOwner(t *testing.T) {
+	for _, c := range []struct {
+		version   int
+		reassigns int
+	}{
+		{version: 140000, reassigns: 1},
+		{version: 160000, reassigns: 2},
+	} {
+		m := &mockProcessor{}
+		setMockProcessor(m)
+
+		m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
+		m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+		m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "postgres").Return(true, nil)
+		m.On("ServerVersion", mock.Anything, mock.Anything).Return(c.version, nil)
+		m.On("OwnedObjects", mock.Anything, mock.Anything, "postgres").Return([]DatabaseObject{
+			{Kind: "SCHEMA", Identity: "public"},
+			{Kind: "TABLE", Identity: "public.bongo"},
+		}, nil)
+		m.On("ReassignObject", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(nil)
+		m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+		m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+		HandleCluster(context.Background(), k8s.ClusterResult{
+			Name:      "test",
+			Namespace: "test",
+			Superuser: testSuperuser(),
+			Users: []k8s.ClusterUser{
+				{
+					Name:      "bongo",
+					Databases: []string{"postgres"},
+				},
+			},
+			ReassignObjects: true,
+		})
+
+		m.AssertNumberOfCalls(t, "ReassignObject", c.reassigns)
+		m.AssertCalled(t, "ReassignObject", mock.Anything, mock.Anything, DatabaseObject{Kind: "TABLE", Identity: "public.bongo"}, "bongo")
+	}
+}
+
+func TestItReassignsObjectsOnceForDatabasesWithMultipleUsers(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("UserExists", mock.Anything, mock.Anything, mock.Anything).Return(true, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("ServerVersion", mock.Anything, mock.Anything).Return(160000, nil)
+	m.On("OwnedObjects", mock.Anything, mock.Anything, "postgres").Return([]DatabaseObject{
+		{Kind: "TABLE", Identity: "public.bongo"},
+	}, nil)
+	m.On("ReassignObject", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name:      "bongo",
+				Databases: []string{"postgres"},
+			},
+			{
+				Name:      "bingo",
+				Databases: []string{"postgres"},
+			},
+		},
+		ReassignObjects: true,
+	})
+
+	m.AssertNumberOfCalls(t, "OwnedObjects", 1)
+	m.AssertNumberOfCalls(t, "ReassignObject", 1)
+	m.AssertNotCalled(t, "ReassignObject", mock.Anything, mock.Anything, mock.Anything, "bingo")
+}
+
+func TestItHardensManagedDatabases(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	connect := GrantTarget{User: "bingo", Database: "postgres", Objects: GrantDatabase}
+	pgbouncer := GrantTarget{User: "_crunchypgbouncer", Database: "postgres", Objects: GrantDatabase}
+
+	m.On("UserExists", mock.Anything, mock.Anything, "ccp_monitoring").Return(false, nil)
+	m.On("UserExists", mock.Anything, mock.Anything, mock.Anything).Return(true, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "postgres").Return(true, nil)
+	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bingo", "postgres").Return(false, nil)
+	m.On("MakeUserOwner", mock.Anything, mock.Anything, "postgres", "bingo").Return(nil)
+	m.On("DatabaseOwner", mock.Anything, mock.Anything, "postgres").Return("bongo", nil)
+	m.On("Privileges", mock.Anything, mock.Anything, connect).Return(Privileges{All: []string{}, Any: []string{}}, nil)
+	m.On("GrantPrivileges", mock.Anything, mock.Anything, connect, []string{"CONNECT"}).Return(nil)
+	m.On("Privileges", mock.Anything, mock.Anything, pgbouncer).Return(Privileges{All: []string{}, Any: []string{}}, nil)
+	m.On("GrantPrivileges", mock.Anything, mock.Anything, pgbouncer, []string{"CONNECT"}).Return(nil)
+	m.On("PublicDatabasePrivileges", mock.Anything, mock.Anything, "postgres").Return([]string{"CONNECT", "TEMPORARY"}, nil)
+	m.On("RevokePublicDatabasePrivileges", mock.Anything, mock.Anything, "postgres", []string{"CONNECT"}).Return(nil)
+	m.On("PublicCanCreateInPublicSchema", mock.Anything, mock.Anything).Return(true, nil)
+	m.On("RevokePublicSchemaCreate", mock.Anything, mock.Anything).Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name:      "bongo",
+				Databases: []string{"postgres"},
+			},
+			{
+				Name:      "bingo",
+				Databases: []string{"postgres"},
+			},
+		},
+		Harden: true,
+	})
+
+	// pgBouncer keeps access, and ccp_monitoring doesn't exist
+	m.AssertNumberOfCalls(t, "GrantPrivileges", 2)
+	m.AssertCalled(t, "GrantPrivileges", mock.Anything, mock.Anything, pgbouncer, []string{"CONNECT"})
+	m.AssertNumberOfCalls(t, "RevokePublicDatabasePrivileges", 1)
+	m.AssertNumberOfCalls(t, "RevokePublicSchemaCreate", 1)
+}
+
+func TestItCreatesDatabasesThatDontExist(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	spec := k8s.DatabaseSpec{
+		Database:  "bongo",
+		Template:  "template0",
+		Encoding:  "UTF8",
+		IcuLocale: "en-GB",
+	}
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(false, nil)
+	m.On("CreateDatabase", mock.Anything, mock.Anything, spec).Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Databases: []k8s.DatabaseSpec{spec},
+	})
+
+	m.AssertNumberOfCalls(t, "CreateDatabase", 1)
+	m.AssertNotCalled(t, "DatabaseOptions")
+}
+
+func TestItDoesntCreateDatabasesThatExist(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("DatabaseOptions", mock.Anything, mock.Anything, "bongo").Return(k8s.DatabaseSpec{
+		Database:  "bongo",
+		Encoding:  "UTF8",
+		LcCollate: "en_US.utf8",
+	}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Databases: []k8s.DatabaseSpec{
+			{
+				Database:  "bongo",
+				Encoding:  "utf8",
+				LcCollate: "en_US.UTF-8",
+			},
+		},
+	})
+
+	m.AssertNotCalled(t, "CreateDatabase")
+}
+
+func TestItAppliesPendingMigrations(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	applied := k8s.Migration{Version: "001_init.sql", SQL: "CREATE TABLE bongo ();"}
+	pending := k8s.Migration{Version: "002_rls.sql", SQL: "ALTER TABLE bongo ENABLE ROW LEVEL SECURITY;"}
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("AppliedMigrations", mock.Anything, mock.Anything).Return(map[string]string{
+		applied.Version: applied.Checksum(),
+	}, nil)
+	m.On("ApplyMigration", mock.Anything, mock.Anything, pending).Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Migrations: map[string][]k8s.Migration{
+			"postgres": {applied, pending},
+		},
+	})
+
+	m.AssertNumberOfCalls(t, "ApplyMigration", 1)
+}
+
+func TestItDoesntApplyMigrationsWhenAnAppliedOneChanged(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("AppliedMigrations", mock.Anything, mock.Anything).Return(map[string]string{
+		"001_init.sql": "bongo",
+	}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Migrations: map[string][]k8s.Migration{
+			"postgres": {
+				{Version: "001_init.sql", SQL: "CREATE TABLE bongo ();"},
+				{Version: "002_rls.sql", SQL: "ALTER TABLE bongo ENABLE ROW LEVEL SECURITY;"},
+			},
+		},
+	})
+
+	m.AssertNotCalled(t, "ApplyMigration")
+}
+
+func TestItReconcilesCronJobs(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	vacuum := k8s.CronJob{Name: "vacuum", Schedule: "0 3 * * *", Database: "bongo", Command: "VACUUM", Owner: "bongo"}
+	cleanup := k8s.CronJob{Name: "cleanup", Schedule: "*/5 * * * *", Database: "bongo", Command: "CALL cleanup()", Owner: "postgres"}
+
+	m.On("ExtensionExists", mock.Anything, mock.Anything, "pg_cron").Return(true, nil)
+	m.On("CronJobs", mock.Anything, mock.Anything).Return([]ScheduledJob{
+		{ID: 1, Name: "vacuum", Schedule: "0 3 * * *", Database: "bongo", Command: "VACUUM", Owner: "bongo"},
+		{ID: 2, Name: "cleanup", Schedule: "0 * * * *", Database: "bongo", Command: "CALL cleanup()", Owner: "postgres"},
+		{ID: 3, Name: "old", Schedule: "0 * * * *", Database: "bongo", Command: "SELECT 1", Owner: "postgres"},
+		{ID: 4, Name: "manual", Schedule: "0 * * * *", Database: "bongo", Command: "SELECT 1", Owner: "postgres"},
+	}, nil)
+	m.On("ScheduleCronJob", mock.Anything, mock.Anything, cleanup).Return(nil)
+	m.On("RecordCronJob", mock.Anything, mock.Anything, "cleanup").Return(nil)
+	m.On("ManagedCronJobs", mock.Anything, mock.Anything).Return([]string{"cleanup", "old", "vacuum"}, nil)
+	m.On("UnscheduleCronJob", mock.Anything, mock.Anything, int64(3)).Return(nil)
+	m.On("ForgetCronJob", mock.Anything, mock.Anything, "old").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		CronJobs: []k8s.CronJob{
+			vacuum,
+			{Name: cleanup.Name, Schedule: cleanup.Schedule, Database: cleanup.Database, Command: cleanup.Command},
+		},
+	})
+
+	m.AssertNumberOfCalls(t, "ScheduleCronJob", 1)
+	m.AssertNumberOfCalls(t, "UnscheduleCronJob", 1)
+	m.AssertNumberOfCalls(t, "ForgetCronJob", 1)
+}
+
+func TestItDoesntScheduleCronJobsWithoutPgCron(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("ExtensionExists", mock.Anything, mock.Anything, "pg_cron").Return(false, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		CronJobs: []k8s.CronJob{
+			{Name: "vacuum", Schedule: "0 3 * * *", Database: "bongo", Command: "VACUUM"},
+		},
+	})
+
+	m.AssertNotCalled(t, "CronJobs")
+	m.AssertNotCalled(t, "ScheduleCronJob")
+}
+
+func TestItCreatesForeignServers(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("ExtensionExists", mock.Anything, mock.Anything, "postgres_fdw").Return(true, nil)
+	m.On("ForeignServerOptions", mock.Anything, mock.Anything, "reporting").Return(map[string]string(nil), false, nil)
+	m.On("CreateForeignServer", mock.Anything, mock.Anything, "reporting", map[string]string{
+		"host":   "source-primary.test.svc",
+		"port":   "5432",
+		"dbname": "bongo",
+	}).Return(nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("UserMappingOptions", mock.Anything, mock.Anything, "reporting", "").Return(map[string]string(nil), false, nil)
+	m.On("CreateUserMapping", mock.Anything, mock.Anything, "reporting", "", map[string]string{
+		"user":     "bongo",
+		"password": "rotated",
+	}).Return(nil)
+	m.On("HasForeignTables", mock.Anything, mock.Anything, "reporting", "source").Return(false, nil)
+	m.On("CreateSchema", mock.Anything, mock.Anything, "source", "").Return(nil)
+	m.On("ImportForeignSchema", mock.Anything, mock.Anything, "reporting", "public", "source").Return(nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		ForeignServers: map[string][]k8s.ForeignServer{
+			"postgres": {testForeignServer()},
+		},
+	})
+
+	m.AssertNumberOfCalls(t, "CreateForeignServer", 1)
+	m.AssertNumberOfCalls(t, "CreateUserMapping", 1)
+	m.AssertNumberOfCalls(t, "ImportForeignSchema", 1)
+}
+
+func TestItUpdatesUserMappingsWhenThePasswordRotates(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("ExtensionExists", mock.Anything, mock.Anything, "postgres_fdw").Return(true, nil)
+	m.On("ForeignServerOptions", mock.Anything, mock.Anything, "reporting").Return(map[string]string{
+		"host":   "source-primary.test.svc",
+		"port":   "5432",
+		"dbname": "bongo",
+	}, true, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("UserMappingOptions", mock.Anything, mock.Anything, "reporting", "").Return(map[string]string{
+		"user":     "bongo",
+		"password": "stale",
+	}, true, nil)
+	m.On("AlterUserMapping", mock.Anything, mock.Anything, "reporting", "", []string{"SET password 'rotated'"}).Return(nil)
+	m.On("HasForeignTables", mock.Anything, mock.Anything, "reporting", "source").Return(true, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		ForeignServers: map[string][]k8s.ForeignServer{
+			"postgres": {testForeignServer()},
+		},
+	})
+
+	m.AssertNotCalled(t, "AlterForeignServer")
+	m.AssertNumberOfCalls(t, "AlterUserMapping", 1)
+	m.AssertNotCalled(t, "ImportForeignSchema")
+}
+
+func TestItSyncsPublicationTables(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("Publication", mock.Anything, mock.Anything, "orders").Return(PublicationState{
+		Tables: []string{"public.orders", "public.customers"},
+	}, true, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("AddPublicationTables", mock.Anything, mock.Anything, "orders", []string{"sales.items"}).Return(nil)
+	m.On("DropPublicationTables", mock.Anything, mock.Anything, "orders", []string{"public.customers"}).Return(nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Publications: map[string][]k8s.Publication{
+			"postgres": {
+				{
+					Database:    "postgres",
+					Publication: "orders",
+					Tables:      []string{"orders", "sales.items"},
+				},
+			},
+		},
+	})
+
+	m.AssertNotCalled(t, "CreatePublication")
+	m.AssertNumberOfCalls(t, "AddPublicationTables", 1)
+	m.AssertNumberOfCalls(t, "DropPublicationTables", 1)
+}
+
+func TestItUpdatesSubscriptionsWhenThePasswordRotates(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	sub := k8s.Subscription{
+		Database:       "postgres",
+		Subscription:   "orders",
+		Cluster:        "source",
+		User:           "postgres",
+		Publications:   []string{"orders"},
+		RemoteDatabase: "orders",
+		Credentials: k8s.ClusterSuperuser{
+			Host:     "source-primary.test.svc",
+			Port:     5432,
+			User:     "postgres",
+			Password: "rotated",
+			Database: "postgres",
+		},
+	}
+	conninfo := "host='source-primary.test.svc' port=5432 dbname='orders' user='postgres' password='rotated'"
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("Subscription", mock.Anything, mock.Anything, "orders").Return(SubscriptionState{
+		ConnInfo:     "host='source-primary.test.svc' port=5432 dbname='orders' user='postgres' password='stale'",
+		Publications: []string{"orders"},
+	}, true, nil)
+	m.On("SetSubscriptionConnection", mock.Anything, mock.Anything, "orders", conninfo).Return(nil)
+	m.On("PublishedTables", mock.Anything, conninfo, []string{"orders"}).Return([]string{"public.items", "public.orders"}, nil)
+	m.On("SubscribedTables", mock.Anything, mock.Anything, "orders").Return([]string{"public.orders"}, nil)
+	m.On("RefreshSubscription", mock.Anything, mock.Anything, "orders").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Subscriptions: map[string][]k8s.Subscription{
+			"postgres": {sub},
+		},
+	})
+
+	m.AssertNotCalled(t, "CreateSubscription")
+	m.AssertNumberOfCalls(t, "SetSubscriptionConnection", 1)
+	m.AssertNotCalled(t, "SetSubscriptionPublications")
+	m.AssertNumberOfCalls(t, "RefreshSubscription", 1)
+}
+
+func TestItDoesntRefreshSubscriptionsWhenThePublishedTablesMatch(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	sub := k8s.Subscription{
+		Database:       "postgres",
+		Subscription:   "orders",
+		Cluster:        "source",
+		User:           "postgres",
+		Publications:   []string{"orders"},
+		RemoteDatabase: "orders",
+		Credentials: k8s.ClusterSuperuser{
+			Host:     "source-primary.test.svc",
+			Port:     5432,
+			User:     "postgres",
+			Password: "bongo",
+			Database: "postgres",
+		},
+	}
+	conninfo := "host='source-primary.test.svc' port=5432 dbname='orders' user='postgres' password='bongo'"
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("Subscription", mock.Anything, mock.Anything, "orders").Return(SubscriptionState{
+		ConnInfo:     conninfo,
+		Publications: []string{"orders"},
+	}, true, nil)
+	m.On("PublishedTables", mock.Anything, conninfo, []string{"orders"}).Return([]string{"public.items", "public.orders"}, nil)
+	m.On("SubscribedTables", mock.Anything, mock.Anything, "orders").Return([]string{"public.items", "public.orders"}, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Subscriptions: map[string][]k8s.Subscription{
+			"postgres": {sub},
+		},
+	})
+
+	m.AssertNotCalled(t, "SetSubscriptionConnection")
+	m.AssertNotCalled(t, "SetSubscriptionPublications")
+	m.AssertNotCalled(t, "RefreshSubscription")
+}
+
+func TestItSetsUpCDC(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserExists", mock.Anything, mock.Anything, "debezium").Return(true, nil)
+	m.On("RoleAttributes", mock.Anything, mock.Anything, "debezium").Return(RoleAttributes{ConnectionLimit: -1}, nil)
+	m.On("AlterRole", mock.Anything, mock.Anything, "debezium", []string{"REPLICATION"}).Return(nil)
+	m.On("Publication", mock.Anything, mock.Anything, "debezium").Return(PublicationState{}, false, nil)
+	m.On("CreatePublication", mock.Anything, mock.Anything, k8s.Publication{
+		Database:    "postgres",
+		Publication: "debezium",
+		Tables:      []string{"orders"},
+	}).Return(nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("TablesWithoutSelect", mock.Anything, mock.Anything, "debezium", []string{"public.orders"}).Return([]string{"public.orders"}, nil)
+	m.On("GrantSelect", mock.Anything, mock.Anything, "debezium", []string{"public.orders"}).Return(nil)
+	m.On("ReplicationSlot", mock.Anything, mock.Anything, "debezium").Return(ReplicationSlot{}, false, nil)
+	m.On("CreateReplicationSlot", mock.Anything, mock.Anything, "debezium", "pgoutput").Return(nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		CDC: map[string][]k8s.CDC{
+			"postgres": {
+				{
+					Database:    "postgres",
+					User:        "debezium",
+					Publication: "debezium",
+					Tables:      []string{"orders"},
+					Slot:        "debezium",
+				},
+			},
+		},
+	})
+
+	m.AssertNumberOfCalls(t, "AlterRole", 1)
+	m.AssertNumberOfCalls(t, "CreatePublication", 1)
+	m.AssertNumberOfCalls(t, "GrantSelect", 1)
+	m.AssertNumberOfCalls(t, "CreateReplicationSlot", 1)
+}
+
+func TestItReportsReplicationSlotLagGrowth(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserExists", mock.Anything, mock.Anything, "debezium").Return(true, nil)
+	m.On("RoleAttributes", mock.Anything, mock.Anything, "debezium").Return(RoleAttributes{ConnectionLimit: -1, Replication: true}, nil)
+	m.On("Publication", mock.Anything, mock.Anything, "debezium").Return(PublicationState{Tables: []string{"public.orders"}}, true, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("TablesWithoutSelect", mock.Anything, mock.Anything, "debezium", []string{"public.orders"}).Return([]string{}, nil)
+	m.On("ReplicationSlot", mock.Anything, mock.Anything, "debezium").Return(ReplicationSlot{Plugin: "pgoutput", LagBytes: 100}, true, nil).Once()
+	m.On("ReplicationSlot", mock.Anything, mock.Anything, "debezium").Return(ReplicationSlot{Plugin: "pgoutput", LagBytes: 200}, true, nil).Once()
+
+	cluster := k8s.ClusterResult{
+		Name:      "lagging",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		CDC: map[string][]k8s.CDC{
+			"postgres": {
+				{
+					Database:          "postgres",
+					User:              "debezium",
+					Publication:       "debezium",
+					Tables:            []string{"orders"},
+					Slot:              "debezium",
+					LagThresholdBytes: 50,
+				},
+			},
+		},
+	}
+
+	if outcome, _ := HandleCluster(context.Background(), cluster); outcome.Failed("postgres") {
+		t.Errorf("expected the first check not to fail, got %v", outcome.Errors["postgres"])
+	}
+	outcome, _ := HandleCluster(context.Background(), cluster)
+	if !outcome.Failed("postgres") {
+		t.Errorf("expected the growing lag to be reported")
+	}
+}
+
+func TestItCreatesExtensionsInTemplateDatabases(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "template1").Return(true, nil)
+	m.On("IsTemplateDatabase", mock.Anything, mock.Anything, "template1").Return(true, nil)
+	m.On("ExtensionExists", mock.Anything, mock.Anything, "pgcrypto").Return(false, nil)
+	m.On("CreateExtension", mock.Anything, mock.Anything, "pgcrypto", false, "", "").Return(nil)
+	m.On("RecordExtension", mock.Anything, mock.Anything, "template1", "pgcrypto").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	cluster := k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Extensions: map[string][]k8s.DatabaseExtension{
+			"template1": {
+				{
+					Database:  "template1",
+					Extension: "pgcrypto",
+				},
+			},
+		},
+	}
+	HandleCluster(context.Background(), cluster)
+
+	m.AssertNumberOfCalls(t, "CreateExtension", 1)
+	// The connection is closed rather than kept, so the template can
+	// still be copied
+	user := cluster.Superuser
+	user.Database = "template1"
+	if _, ok := dbs.Get(user.Key()); ok {
+		t.Errorf("expected the connection to the template database not to be kept")
+	}
+}
+
+func TestItProcessesExtensionsOnceForDatabasesWithMultipleUsers(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("UserExists", mock.Anything, mock.Anything, mock.Anything).Return(true, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("IsTemplateDatabase", mock.Anything, mock.Anything, mock.Anything).Return(false, nil)
+	m.On("ExtensionExists", mock.Anything, mock.Anything, "vector").Return(false, nil)
+	m.On("CreateExtension", mock.Anything, mock.Anything, "vector", false, "", "").Return(nil)
+	m.On("RecordExtension", mock.Anything, mock.Anything, "postgres", "vector").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name:      "bongo",
+				Databases: []string{"postgres"},
+			},
+			{
+				Name:      "bingo",
+				Databases: []string{"postgres"},
+			},
+		},
+		Extensions: map[string][]k8s.DatabaseExtension{
+			"postgres": {
+				{
+					Database:  "postgres",
+					Extension: "vector",
+				},
+			},
+		},
+	})
+
+	m.AssertNumberOfCalls(t, "ExtensionExists", 1)
+	m.AssertNumberOfCalls(t, "CreateExtension", 1)
+}
+
+func TestItSkipsExtensionsForDatabasesThatDontExist(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(false, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Extensions: map[string][]k8s.DatabaseExtension{
+			"bongo": {
+				{
+					Database:  "bongo",
+					Extension: "vector",
+				},
+			},
+		},
+	})
+
+	m.AssertNotCalled(t, "ExtensionExists")
+	m.AssertNotCalled(t, "CreateExtension")
+}
+
+func TestItReportsTheErrorsForEachDatabase(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(false, errors.New("bongo"))
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bingo").Return(false, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	outcome, err := HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		DatabaseSettings: map[string]k8s.DatabaseSettings{
+			"bongo": {Database: "bongo", Settings: map[string]string{"work_mem": "64MB"}},
+			"bingo": {Database: "bingo", Settings: map[string]string{"work_mem": "64MB"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !outcome.Failed("bongo") {
+		t.Errorf("expected bongo to have failed")
+	}
+	if outcome.Failed("bingo") {
+		t.Errorf("expected bingo not to have failed, got %v", outcome.Errors["bingo"])
+	}
+}
+
+func TestItReportsTheChangesForEachDatabase(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("DatabaseSettings", mock.Anything, mock.Anything, "postgres").Return(map[string]string{"work_mem": "64MB"}, nil)
+	m.On("SetDatabaseSetting", mock.Anything, mock.Anything, "postgres", "statement_timeout", "30s").Return(nil)
+	m.On("RecordDatabaseSetting", mock.Anything, mock.Anything, "postgres", mock.Anything).Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	outcome, _ := HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		DatabaseSettings: map[string]k8s.DatabaseSettings{
+			"postgres": {
+				Database: "postgres",
+				Settings: map[string]string{"work_mem": "64MB", "statement_timeout": "30s"},
+			},
+		},
+	})
+
+	expected := "set database setting (setting=statement_timeout, value=30s)"
+	if len(outcome.Changes["postgres"]) != 1 || outcome.Changes["postgres"][0] != expected {
+		t.Errorf("expected the change %q, got %v", expected, outcome.Changes["postgres"])
+	}
+}
+
+func TestItDoesntReportFailedChanges(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("DatabaseSettings", mock.Anything, mock.Anything, "postgres").Return(map[string]string{}, nil)
+	m.On("SetDatabaseSetting", mock.Anything, mock.Anything, "postgres", "statement_timeout", "30s").Return(errors.New("bongo"))
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	outcome, _ := HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		DatabaseSettings: map[string]k8s.DatabaseSettings{
+			"postgres": {
+				Database: "postgres",
+				Settings: map[string]string{"statement_timeout": "30s"},
+			},
+		},
+	})
+
+	if len(outcome.Changes["postgres"]) != 0 {
+		t.Errorf("expected no changes, got %v", outcome.Changes["postgres"])
+	}
+	if !outcome.Failed("postgres") {
+		t.Errorf("expected postgres to have failed")
+	}
+}
+
+func TestItCountsEachEntryForADatabase(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(false, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	outcome, err := HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Migrations: map[string][]k8s.Migration{
+			"bongo": {{Version: "1"}, {Version: "2"}},
+		},
+		Publications: map[string][]k8s.Publication{
+			"bongo": {
+				{Database: "bongo", Publication: "bingo", AllTables: true},
+				{Database: "bongo", Publication: "bango", AllTables: true},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if outcome.Counts["migrations"] != 2 {
+		t.Errorf("expected 2 migrations to be counted, got %d", outcome.Counts["migrations"])
+	}
+	if outcome.Counts["publications"] != 2 {
+		t.Errorf("expected 2 publications to be counted, got %d", outcome.Counts["publications"])
+	}
+}
+
+func TestItReportsTheStatusOfTheCluster(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("IsTemplateDatabase", mock.Anything, mock.Anything, mock.Anything).Return(false, nil)
+	m.On("ExtensionExists", mock.Anything, mock.Anything, "vector").Return(false, errors.New("bongo"))
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	cluster := k8s.ClusterResult{
+		Name:       "test",
+		Namespace:  "test",
+		Generation: 3,
+		Superuser:  testSuperuser(),
+		Extensions: map[string][]k8s.DatabaseExtension{
+			"postgres": {
+				{
+					Database:  "postgres",
+					Extension: "vector",
+				},
+			},
+		},
+	}
+	outcome, err := HandleCluster(context.Background(), cluster)
+	status := outcome.Status(cluster, err)
+
+	if status.Healthy {
+		t.Errorf("expected the cluster not to be healthy")
+	}
+	if status.ObservedGeneration != 3 {
+		t.Errorf("expected observed generation 3, got %d", status.ObservedGeneration)
+	}
+	if status.Counts["extensions"] != 1 {
+		t.Errorf("expected 1 extension to be counted, got %d", status.Counts["extensions"])
+	}
+	if len(status.Errors.Databases["postgres"]) != 1 {
+		t.Errorf("expected an error for the postgres database, got %v", status.Errors.Databases)
+	}
+	expected := "could not determine if extension exists: bongo"
+	if len(status.Errors.Extensions["vector"]) != 1 || status.Errors.Extensions["vector"][0] != expected {
+		t.Errorf("expected the extension error %q, got %v", expected, status.Errors.Extensions["vector"])
+	}
+}
+
+func TestItCountsSqlErrorsByOperation(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(instrumented{m})
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(false, errors.New("bongo"))
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	before := testutil.ToFloat64(metrics.SQLErrors.WithLabelValues("DatabaseExists"))
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		DatabaseSettings: map[string]k8s.DatabaseSettings{
+			"bongo": {Database: "bongo", Settings: map[string]string{"work_mem": "64MB"}},
+		},
+	})
+
+	if errs := testutil.ToFloat64(metrics.SQLErrors.WithLabelValues("DatabaseExists")) - before; errs != 1 {
+		t.Errorf("expected 1 DatabaseExists error to be counted, got %v", errs)
+	}
+}
+
+func TestItCreatesSchemasInDatabasesNoUserLists(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("SchemaExists", mock.Anything, mock.Anything, "app").Return(false, nil)
+	m.On("CreateSchema", mock.Anything, mock.Anything, "app", "").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Schemas: map[string][]k8s.DatabaseSchema{
+			"postgres": {
+				{
+					Database: "postgres",
+					Schema:   "app",
+				},
+			},
+		},
+	})
+
+	m.AssertNumberOfCalls(t, "CreateSchema", 1)
+}
+
+func TestItProcessesSchemasOnceForDatabasesWithMultipleUsers(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("UserExists", mock.Anything, mock.Anything, "bingo").Return(true, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("SchemaExists", mock.Anything, mock.Anything, "app").Return(false, nil)
+	m.On("CreateSchema", mock.Anything, mock.Anything, "app", "bongo").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name:      "bongo",
+				Databases: []string{"postgres"},
+			},
+			{
+				Name:      "bingo",
+				Databases: []string{"postgres"},
+			},
+		},
+		Schemas: map[string][]k8s.DatabaseSchema{
+			"postgres": {
+				{
+					Database:      "postgres",
+					Schema:        "app",
+					Authorization: "bongo",
+				},
+			},
+		},
+	})
+
+	m.AssertNumberOfCalls(t, "SchemaExists", 1)
+	m.AssertNumberOfCalls(t, "CreateSchema", 1)
+}
+
+func TestItReconcilesDefaultPrivilegesOnceInDatabasesNoUserLists(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	tables := DefaultPrivilegeTarget{Grantor: "bongo", Schema: "public", Grantee: "bingo", Objects: "TABLES"}
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("DefaultPrivileges", mock.Anything, mock.Anything, tables).Return([]string{}, nil)
+	m.On("DefaultPrivileges", mock.Anything, mock.Anything, mock.Anything).Return([]string{}, nil)
+	m.On("GrantDefaultPrivileges", mock.Anything, mock.Anything, tables, []string{"SELECT"}).Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		DefaultPrivileges: map[string][]k8s.DefaultPrivilege{
+			"postgres": {
+				{
+					Database: "postgres",
+					Schema:   "public",
+					Grantor:  "bongo",
+					Grantee:  "bingo",
+					Tables:   []string{"select"},
+				},
+			},
+		},
+	})
+
+	m.AssertNumberOfCalls(t, "DefaultPrivileges", 3)
+	m.AssertNumberOfCalls(t, "GrantDefaultPrivileges", 1)
+}
+
+func TestItDoesntGrantOnSchemasWithoutObjects(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	database := GrantTarget{User: "bingo", Database: "postgres", Objects: GrantDatabase}
+	schema := GrantTarget{User: "bingo", Database: "postgres", Schema: "public", Objects: GrantSchema}
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserExists", mock.Anything, mock.Anything, "bingo").Return(true, nil)
+	m.On("Privileges", mock.Anything, mock.Anything, database).Return(Privileges{All: []string{"CONNECT"}, Any: []string{"CONNECT"}}, nil)
+	m.On("Privileges", mock.Anything, mock.Anything, schema).Return(Privileges{All: []string{"USAGE"}, Any: []string{"USAGE"}}, nil)
+	m.On("Privileges", mock.Anything, mock.Anything, mock.Anything).Return(Privileges{All: []string{}, Any: []string{}, Empty: true}, nil)
+	m.On("RecordGrant", mock.Anything, mock.Anything, "postgres", "bingo", []string{"public"}).Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	outcome, _ := HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Grants: map[string][]k8s.DatabaseGrant{
+			"postgres": {
+				{
+					Database: "postgres",
+					User:     "bingo",
+					Level:    "read",
+				},
+			},
+		},
+	})
+
+	m.AssertNotCalled(t, "GrantPrivileges")
+	m.AssertNotCalled(t, "RevokePrivileges")
+	if len(outcome.Changes["postgres"]) != 0 {
+		t.Errorf("expected no changes, got %v", outcome.Changes["postgres"])
+	}
+}
+
+func TestItRevokesRecordedGrantsRemovedFromTheAnnotation(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	database := GrantTarget{User: "bingo", Database: "postgres", Objects: GrantDatabase}
+	tables := GrantTarget{User: "bingo", Database: "postgres", Schema: "app", Objects: GrantTables}
+
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{
+		"postgres": {"bingo": {"app"}},
+	}, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserExists", mock.Anything, mock.Anything, "bingo").Return(true, nil)
+	m.On("Privileges", mock.Anything, mock.Anything, database).Return(Privileges{All: []string{"CONNECT"}, Any: []string{"CONNECT"}}, nil)
+	m.On("Privileges", mock.Anything, mock.Anything, tables).Return(Privileges{All: []string{"SELECT"}, Any: []string{"SELECT"}}, nil)
+	m.On("Privileges", mock.Anything, mock.Anything, mock.Anything).Return(Privileges{All: []string{}, Any: []string{}}, nil)
+	m.On("RevokePrivileges", mock.Anything, mock.Anything, database, []string{"CONNECT"}).Return(nil)
+	m.On("RevokePrivileges", mock.Anything, mock.Anything, tables, []string{"SELECT"}).Return(nil)
+	m.On("ForgetGrant", mock.Anything, mock.Anything, "postgres", "bingo").Return(nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+	})
+
+	m.AssertNotCalled(t, "GrantPrivileges")
+	m.AssertNumberOfCalls(t, "RevokePrivileges", 2)
+	m.AssertNumberOfCalls(t, "ForgetGrant", 1)
+}
+
+func TestItResetsRecordedSettingsForDatabasesWithoutAnEntry(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{
+		"bongo": {"work_mem"},
+	}, nil)
+	m.On("DatabaseSettings", mock.Anything, mock.Anything, "bongo").Return(map[string]string{"work_mem": "64MB"}, nil)
+	m.On("ResetDatabaseSetting", mock.Anything, mock.Anything, "bongo", "work_mem").Return(nil)
+	m.On("ForgetDatabaseSetting", mock.Anything, mock.Anything, "bongo", "work_mem").Return(nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+	})
+
+	m.AssertNotCalled(t, "SetDatabaseSetting")
+	m.AssertNumberOfCalls(t, "ResetDatabaseSetting", 1)
+	m.AssertNumberOfCalls(t, "ForgetDatabaseSetting", 1)
+}
+
+func TestItDoesntResetSettingsInUserDatabasesItHasntSet(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("UserExists", mock.Anything, mock.Anything, "bongo").Return(true, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("UserIsOwner", mock.Anything, mock.Anything, mock.Anything, "bongo", "postgres").Return(true, nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name:      "bongo",
+				Databases: []string{"postgres"},
+			},
+		},
+	})
+
+	m.AssertNotCalled(t, "DatabaseSettings", mock.Anything, mock.Anything, "postgres")
+	m.AssertNotCalled(t, "ResetDatabaseSetting")
+}
+
+// Uses the real processor's database owner cache, which is shared
+// by every user of a database
+type cachedOwnerProcessor struct {
+	*mockProcessor
+	owners *processor
+}
+
+func (p cachedOwnerProcessor) UserIsOwner(ctx context.Context, db *sql.DB, cluster, user, database string) (bool, error) {
+	return p.owners.UserIsOwner(ctx, db, cluster, user, database)
+}
+
+func TestItHardensSharedDatabasesWhenTheOwnerIsCached(t *testing.T) {
+	m := &mockProcessor{}
+	owners := &processor{
+		userExists:     flow.NewStore[bool](),
+		databaseExists: flow.NewStore[bool](),
+		databaseOwned:  flow.NewStore[bool](),
+	}
+	owners.databaseOwned.Put("test:test:postgres", true)
+	setMockProcessor(cachedOwnerProcessor{mockProcessor: m, owners: owners})
+
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	connect := GrantTarget{User: "bingo", Database: "postgres", Objects: GrantDatabase}
+
+	m.On("UserExists", mock.Anything, mock.Anything, "_crunchypgbouncer").Return(false, nil)
+	m.On("UserExists", mock.Anything, mock.Anything, "ccp_monitoring").Return(false, nil)
+	m.On("UserExists", mock.Anything, mock.Anything, mock.Anything).Return(true, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("DatabaseOwner", mock.Anything, mock.Anything, "postgres").Return("bongo", nil)
+	m.On("Privileges", mock.Anything, mock.Anything, connect).Return(Privileges{All: []string{}, Any: []string{}}, nil)
+	m.On("GrantPrivileges", mock.Anything, mock.Anything, connect, []string{"CONNECT"}).Return(nil)
+	m.On("PublicDatabasePrivileges", mock.Anything, mock.Anything, "postgres").Return([]string{"CONNECT"}, nil)
+	m.On("RevokePublicDatabasePrivileges", mock.Anything, mock.Anything, "postgres", []string{"CONNECT"}).Return(nil)
+	m.On("PublicCanCreateInPublicSchema", mock.Anything, mock.Anything).Return(false, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:      "test",
+		Namespace: "test",
+		Superuser: testSuperuser(),
+		Users: []k8s.ClusterUser{
+			{
+				Name:      "bongo",
+				Databases: []string{"postgres"},
+			},
+			{
+				Name:      "bingo",
+				Databases: []string{"postgres"},
+			},
+		},
+		Harden: true,
+	})
+
+	m.AssertCalled(t, "GrantPrivileges", mock.Anything, mock.Anything, connect, []string{"CONNECT"})
+}
+
+func TestItPrunesExtensionsInDatabasesWithNoneDeclared(t *testing.T) {
+	m := &mockProcessor{}
+	setMockProcessor(m)
+
+	m.On("ExtensionDatabases", mock.Anything, mock.Anything).Return([]string{"postgres"}, nil)
+	m.On("DatabaseExists", mock.Anything, mock.Anything, mock.Anything, "postgres").Return(true, nil)
+	m.On("IsTemplateDatabase", mock.Anything, mock.Anything, mock.Anything).Return(false, nil)
+	m.On("InstalledExtensions", mock.Anything, mock.Anything, "postgres").Return([]string{"vector"}, nil)
+	m.On("DropExtension", mock.Anything, mock.Anything, "vector", false).Return(nil)
+	m.On("ForgetExtension", mock.Anything, mock.Anything, "postgres", "vector").Return(nil)
+	m.On("RecordedGrants", mock.Anything, mock.Anything).Return(map[string]map[string][]string{}, nil)
+	m.On("RecordedDatabaseSettings", mock.Anything, mock.Anything).Return(map[string][]string{}, nil)
+
+	HandleCluster(context.Background(), k8s.ClusterResult{
+		Name:            "test",
+		Namespace:       "test",
+		Superuser:       testSuperuser(),
+		PruneExtensions: true,
+	})
+
+	m.AssertNumberOfCalls(t, "DropExtension", 1)
+	m.AssertNumberOfCalls(t, "ForgetExtension", 1)
+}
+
+func TestItCreatesDatabasesFromTemplate0WhenTheLocaleIsSet(t *testing.T) {
+	for _, c := range []struct {
+		spec     k8s.DatabaseSpec
+		expected string
+	}{
+		{
+			spec:     k8s.DatabaseSpec{Database: "bongo", Owner: "bingo"},
+			expected: `CREATE DATABASE "bongo" OWNER "bingo"`,
+		},
+		{
+			spec:     k8s.DatabaseSpec{Database: "bongo", Encoding: "UTF8", LcCollate: "C", LcCtype: "C"},
+			expected: `CREATE DATABASE "bongo" TEMPLATE "template0" ENCODING 'UTF8' LC_COLLATE 'C' LC_CTYPE 'C'`,
+		},
+		{
+			spec:     k8s.DatabaseSpec{Database: "bongo", IcuLocale: "en-GB"},
+			expected: `CREATE DATABASE "bongo" TEMPLATE "template0" LOCALE_PROVIDER icu ICU_LOCALE 'en-GB'`,
+		},
+		{
+			spec:     k8s.DatabaseSpec{Database: "bongo", Template: "bingo", Encoding: "UTF8"},
+			expected: `CREATE DATABASE "bongo" TEMPLATE "bingo" ENCODING 'UTF8'`,
+		},
+	} {
+		if query := createDatabaseQuery(c.spec); query != c.expected {
+			t.Errorf("expected %q, got %q", c.expected, query)
+		}
+	}
+}
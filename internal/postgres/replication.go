@@ -0,0 +1,390 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
+	"go.uber.org/zap"
+)
+
+// The state of a publication as it is in pg_publication
+type PublicationState struct {
+	AllTables bool
+	Tables    []string
+}
+
+// The state of a subscription as it is in pg_subscription
+type SubscriptionState struct {
+	ConnInfo     string
+	Publications []string
+}
+
+func (p *processor) Publication(ctx context.Context, db *sql.DB, publication string) (PublicationState, bool, error) {
+	out := PublicationState{Tables: []string{}}
+	row := db.QueryRowContext(ctx, "SELECT puballtables FROM pg_catalog.pg_publication WHERE pubname = $1", publication)
+	if err := row.Scan(&out.AllTables); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return out, false, nil
+		}
+		return out, false, err
+	}
+
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT schemaname || '.' || tablename
+		FROM pg_catalog.pg_publication_tables
+		WHERE pubname = $1
+		ORDER BY 1`,
+		publication,
+	)
+	if err != nil {
+		return out, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return out, false, err
+		}
+		out.Tables = append(out.Tables, table)
+	}
+	return out, true, rows.Err()
+}
+
+func (p *processor) CreatePublication(ctx context.Context, db *sql.DB, publication k8s.Publication) error {
+	query := fmt.Sprintf("CREATE PUBLICATION \"%s\"", publication.Publication)
+	if publication.AllTables {
+		query = fmt.Sprintf("%s FOR ALL TABLES", query)
+	} else if len(publication.Tables) > 0 {
+		query = fmt.Sprintf("%s FOR TABLE %s", query, quoteTables(publicationTables(publication)))
+	}
+	_, err := db.ExecContext(ctx, query)
+	return err
+}
+
+func (p *processor) AddPublicationTables(ctx context.Context, db *sql.DB, publication string, tables []string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER PUBLICATION \"%s\" ADD TABLE %s", publication, quoteTables(tables)))
+	return err
+}
+
+func (p *processor) DropPublicationTables(ctx context.Context, db *sql.DB, publication string, tables []string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER PUBLICATION \"%s\" DROP TABLE %s", publication, quoteTables(tables)))
+	return err
+}
+
+func (p *processor) Subscription(ctx context.Context, db *sql.DB, subscription string) (SubscriptionState, bool, error) {
+	row := db.QueryRowContext(
+		ctx,
+		`SELECT subconninfo, array_to_json(subpublication)::text
+		FROM pg_catalog.pg_subscription
+		WHERE subname = $1 AND subdbid = (SELECT oid FROM pg_catalog.pg_database WHERE datname = current_database())`,
+		subscription,
+	)
+	var out SubscriptionState
+	var publications string
+	if err := row.Scan(&out.ConnInfo, &publications); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return out, false, nil
+		}
+		return out, false, err
+	}
+	if err := json.Unmarshal([]byte(publications), &out.Publications); err != nil {
+		return out, false, err
+	}
+	return out, true, nil
+}
+
+func (p *processor) CreateSubscription(ctx context.Context, db *sql.DB, subscription, conninfo string, publications []string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE SUBSCRIPTION \"%s\" CONNECTION %s PUBLICATION %s",
+		subscription,
+		quoteLiteral(conninfo),
+		quoteIdentifiers(publications),
+	))
+	return err
+}
+
+func (p *processor) SetSubscriptionConnection(ctx context.Context, db *sql.DB, subscription, conninfo string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"ALTER SUBSCRIPTION \"%s\" CONNECTION %s",
+		subscription,
+		quoteLiteral(conninfo),
+	))
+	return err
+}
+
+func (p *processor) SetSubscriptionPublications(ctx context.Context, db *sql.DB, subscription string, publications []string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"ALTER SUBSCRIPTION \"%s\" SET PUBLICATION %s",
+		subscription,
+		quoteIdentifiers(publications),
+	))
+	return err
+}
+
+func (p *processor) RefreshSubscription(ctx context.Context, db *sql.DB, subscription string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER SUBSCRIPTION \"%s\" REFRESH PUBLICATION", subscription))
+	return err
+}
+
+// The tables the subscription currently replicates, from
+// pg_subscription_rel
+func (p *processor) SubscribedTables(ctx context.Context, db *sql.DB, subscription string) ([]string, error) {
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT n.nspname || '.' || c.relname
+		FROM pg_catalog.pg_subscription_rel r
+		JOIN pg_catalog.pg_subscription s ON s.oid = r.srsubid
+		JOIN pg_catalog.pg_class c ON c.oid = r.srrelid
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE s.subname = $1
+		ORDER BY 1`,
+		subscription,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanTables(rows)
+}
+
+// The tables the publications publish, read from the publisher with
+// the subscription's connection string. The connection is closed
+// once they have been read.
+func (p *processor) PublishedTables(ctx context.Context, conninfo string, publications []string) ([]string, error) {
+	db, err := sql.Open("pgx", conninfo)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT DISTINCT schemaname || '.' || tablename
+		FROM pg_catalog.pg_publication_tables
+		WHERE pubname = ANY($1)
+		ORDER BY 1`,
+		publications,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanTables(rows)
+}
+
+func scanTables(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		out = append(out, table)
+	}
+	return out, rows.Err()
+}
+
+// Creates the publication, and adds and drops tables so it publishes
+// exactly the declared ones
+func handlePublication(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	cluster k8s.ClusterResult,
+	publication k8s.Publication,
+) {
+	l := logger.With("database", publication.Database, "publication", publication.Publication)
+	l.Debug("processing publication")
+
+	if exists, err := processor.DatabaseExists(ctx, db, cluster.Key(), publication.Database); err != nil {
+		l.Errorw("could not determine if database exists", "error", err)
+		return
+	} else if !exists {
+		l.Debug("database does not exist, skipping")
+		return
+	}
+
+	ddb, err := getDatabaseDb(ctx, cluster, publication.Database)
+	if err != nil {
+		l.Errorw("could not connect to database", "error", err)
+		return
+	}
+	current, exists, err := processor.Publication(ctx, ddb, publication.Publication)
+	if err != nil {
+		l.Errorw("could not get publication", "error", err)
+		return
+	}
+	if !exists {
+		if err := processor.CreatePublication(ctx, ddb, publication); err != nil {
+			l.Errorw("could not create publication", "error", err)
+		} else {
+			changed(l, "created publication")
+		}
+		return
+	}
+	if current.AllTables != publication.AllTables {
+		l.Errorw("publication has to be recreated to change whether it is for all tables")
+		return
+	}
+	if current.AllTables {
+		return
+	}
+
+	add, drop := diff(publicationTables(publication), current.Tables)
+	if len(add) > 0 {
+		if err := processor.AddPublicationTables(ctx, ddb, publication.Publication, add); err != nil {
+			l.Errorw("could not add tables to publication", "error", err)
+		} else {
+			changed(l, "added tables to publication", "tables", add)
+		}
+	}
+	if len(drop) > 0 {
+		if err := processor.DropPublicationTables(ctx, ddb, publication.Publication, drop); err != nil {
+			l.Errorw("could not drop tables from publication", "error", err)
+		} else {
+			changed(l, "dropped tables from publication", "tables", drop)
+		}
+	}
+}
+
+// Creates the subscription to the publishing cluster, updating its
+// connection when the publisher's details or password change and
+// its publications when they are changed. Existing subscriptions are
+// refreshed when the publications' tables no longer match the ones
+// being replicated, so tables added to them are picked up.
+func handleSubscription(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	cluster k8s.ClusterResult,
+	sub k8s.Subscription,
+) {
+	l := logger.With("database", sub.Database, "subscription", sub.Subscription)
+	l.Debug("processing subscription")
+
+	if exists, err := processor.DatabaseExists(ctx, db, cluster.Key(), sub.Database); err != nil {
+		l.Errorw("could not determine if database exists", "error", err)
+		return
+	} else if !exists {
+		l.Debug("database does not exist, skipping")
+		return
+	}
+
+	ddb, err := getDatabaseDb(ctx, cluster, sub.Database)
+	if err != nil {
+		l.Errorw("could not connect to database", "error", err)
+		return
+	}
+	conninfo := subscriptionConnInfo(sub)
+	current, exists, err := processor.Subscription(ctx, ddb, sub.Subscription)
+	if err != nil {
+		l.Errorw("could not get subscription", "error", err)
+		return
+	}
+	if !exists {
+		if err := processor.CreateSubscription(ctx, ddb, sub.Subscription, conninfo, sub.Publications); err != nil {
+			l.Errorw("could not create subscription", "error", err)
+		} else {
+			changed(l, "created subscription")
+		}
+		return
+	}
+
+	if current.ConnInfo != conninfo {
+		// The connection string has the password in it, so it isn't
+		// logged
+		if err := processor.SetSubscriptionConnection(ctx, ddb, sub.Subscription, conninfo); err != nil {
+			l.Errorw("could not update subscription connection", "error", err)
+			return
+		}
+		changed(l, "updated subscription connection")
+	}
+
+	if add, drop := diff(sub.Publications, current.Publications); len(add) > 0 || len(drop) > 0 {
+		if err := processor.SetSubscriptionPublications(ctx, ddb, sub.Subscription, sub.Publications); err != nil {
+			l.Errorw("could not update subscription publications", "error", err)
+		} else {
+			changed(l, "updated subscription publications", "publications", sub.Publications)
+		}
+		return
+	}
+
+	published, err := processor.PublishedTables(ctx, conninfo, sub.Publications)
+	if err != nil {
+		l.Errorw("could not get published tables", "error", err)
+		return
+	}
+	subscribed, err := processor.SubscribedTables(ctx, ddb, sub.Subscription)
+	if err != nil {
+		l.Errorw("could not get subscribed tables", "error", err)
+		return
+	}
+	add, drop := diff(published, subscribed)
+	if len(add) == 0 && len(drop) == 0 {
+		l.Debug("subscription is up to date")
+		return
+	}
+	if err := processor.RefreshSubscription(ctx, ddb, sub.Subscription); err != nil {
+		l.Errorw("could not refresh subscription", "error", err)
+	} else {
+		changed(l, "refreshed subscription", "added", add, "dropped", drop)
+	}
+}
+
+// The connection string a subscription uses to connect to the
+// publishing cluster
+func subscriptionConnInfo(sub k8s.Subscription) string {
+	value := func(v string) string {
+		return fmt.Sprintf("'%s'", strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(v))
+	}
+	return fmt.Sprintf(
+		"host=%s port=%d dbname=%s user=%s password=%s",
+		value(sub.Credentials.Host),
+		sub.Credentials.Port,
+		value(sub.RemoteDatabase),
+		value(sub.Credentials.User),
+		value(sub.Credentials.Password),
+	)
+}
+
+// The publication's tables, qualified with the public schema when
+// they aren't already
+func publicationTables(publication k8s.Publication) []string {
+	out := []string{}
+	for _, table := range publication.Tables {
+		if !strings.Contains(table, ".") {
+			table = fmt.Sprintf("public.%s", table)
+		}
+		out = append(out, table)
+	}
+	return out
+}
+
+func quoteTables(tables []string) string {
+	out := []string{}
+	for _, table := range tables {
+		schema, name, _ := strings.Cut(table, ".")
+		out = append(out, fmt.Sprintf("\"%s\".\"%s\"", schema, name))
+	}
+	return strings.Join(out, ", ")
+}
+
+func quoteIdentifiers(names []string) string {
+	out := []string{}
+	for _, name := range names {
+		out = append(out, fmt.Sprintf("\"%s\"", name))
+	}
+	return strings.Join(out, ", ")
+}
+
+func quoteLiteral(value string) string {
+	return fmt.Sprintf("'%s'", strings.ReplaceAll(value, "'", "''"))
+}
@@ -0,0 +1,220 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
+	"go.uber.org/zap"
+)
+
+// The attributes of a role as they are in pg_roles
+type RoleAttributes struct {
+	ConnectionLimit int
+	CreateDB        bool
+	CreateRole      bool
+	BypassRLS       bool
+	Replication     bool
+	// Nil when the role never expires
+	ValidUntil *time.Time
+}
+
+func (p *processor) RoleAttributes(ctx context.Context, db *sql.DB, user string) (RoleAttributes, error) {
+	row := db.QueryRowContext(
+		ctx,
+		`SELECT rolconnlimit, rolcreatedb, rolcreaterole, rolbypassrls, rolreplication,
+			CASE WHEN rolvaliduntil IS NULL OR rolvaliduntil = 'infinity' THEN NULL
+			ELSE extract(epoch FROM rolvaliduntil)::bigint END
+		FROM pg_catalog.pg_roles WHERE rolname = $1 LIMIT 1`,
+		user,
+	)
+	var out RoleAttributes
+	var validUntil sql.NullInt64
+	if err := row.Scan(
+		&out.ConnectionLimit,
+		&out.CreateDB,
+		&out.CreateRole,
+		&out.BypassRLS,
+		&out.Replication,
+		&validUntil,
+	); err != nil {
+		return out, err
+	}
+	if validUntil.Valid {
+		t := time.Unix(validUntil.Int64, 0).UTC()
+		out.ValidUntil = &t
+	}
+	return out, nil
+}
+
+func (p *processor) AlterRole(ctx context.Context, db *sql.DB, user string, options []string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER ROLE \"%s\" WITH %s", user, strings.Join(options, " ")))
+	return err
+}
+
+// Updates the role's attributes to match those declared in the
+// roles annotation
+func handleRoleAttributes(
+	ctx context.Context,
+	l *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	desired k8s.RoleAttributes,
+) {
+	l.Debug("processing role attributes")
+	current, err := processor.RoleAttributes(ctx, db, desired.User)
+	if err != nil {
+		l.Errorw("could not get role attributes", "error", err)
+		return
+	}
+
+	options, err := roleOptions(desired, current)
+	if err != nil {
+		l.Errorw("invalid role attributes", "error", err)
+		return
+	}
+	if len(options) == 0 {
+		l.Debug("role attributes are up to date")
+		return
+	}
+
+	if err := processor.AlterRole(ctx, db, desired.User, options); err != nil {
+		l.Errorw("could not update role attributes", "error", err)
+	} else {
+		changed(l, "updated role attributes", "options", options)
+	}
+}
+
+// Builds the ALTER ROLE options needed to get from the current
+// attributes to the desired ones
+func roleOptions(desired k8s.RoleAttributes, current RoleAttributes) ([]string, error) {
+	options := []string{}
+	flag := func(want *bool, have bool, name string) {
+		if want == nil || *want == have {
+			return
+		}
+		if *want {
+			options = append(options, name)
+		} else {
+			options = append(options, fmt.Sprintf("NO%s", name))
+		}
+	}
+	flag(desired.CreateDB, current.CreateDB, "CREATEDB")
+	flag(desired.CreateRole, current.CreateRole, "CREATEROLE")
+	flag(desired.BypassRLS, current.BypassRLS, "BYPASSRLS")
+	flag(desired.Replication, current.Replication, "REPLICATION")
+
+	if desired.ConnectionLimit != nil && *desired.ConnectionLimit != current.ConnectionLimit {
+		options = append(options, fmt.Sprintf("CONNECTION LIMIT %d", *desired.ConnectionLimit))
+	}
+
+	if desired.ValidUntil != nil {
+		if *desired.ValidUntil == "infinity" {
+			if current.ValidUntil != nil {
+				options = append(options, "VALID UNTIL 'infinity'")
+			}
+		} else {
+			until, err := time.Parse(time.RFC3339, *desired.ValidUntil)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse validUntil: %w", err)
+			}
+			if current.ValidUntil == nil || !current.ValidUntil.Equal(until.Truncate(time.Second)) {
+				options = append(options, fmt.Sprintf("VALID UNTIL '%s'", until.Format(time.RFC3339)))
+			}
+		}
+	}
+
+	return options, nil
+}
+
+func (p *processor) RoleMemberships(ctx context.Context, db *sql.DB, user string) ([]string, error) {
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT r.rolname
+		FROM pg_catalog.pg_auth_members m
+		JOIN pg_catalog.pg_roles r ON r.oid = m.roleid
+		JOIN pg_catalog.pg_roles u ON u.oid = m.member
+		WHERE u.rolname = $1
+		ORDER BY r.rolname`,
+		user,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []string{}
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		out = append(out, role)
+	}
+	return out, rows.Err()
+}
+
+func (p *processor) CreateGroupRole(ctx context.Context, db *sql.DB, role string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("CREATE ROLE \"%s\" NOLOGIN", role))
+	return err
+}
+
+func (p *processor) GrantRole(ctx context.Context, db *sql.DB, role, user string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("GRANT \"%s\" TO \"%s\"", role, user))
+	return err
+}
+
+func (p *processor) RevokeRole(ctx context.Context, db *sql.DB, role, user string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("REVOKE \"%s\" FROM \"%s\"", role, user))
+	return err
+}
+
+// Grants and revokes role memberships so the user is a member
+// of exactly the declared roles, creating missing group roles
+func handleRoleMemberships(
+	ctx context.Context,
+	l *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	membership k8s.RoleMembership,
+) {
+	l.Debug("processing role memberships")
+	current, err := processor.RoleMemberships(ctx, db, membership.User)
+	if err != nil {
+		l.Errorw("could not get role memberships", "error", err)
+		return
+	}
+
+	grant, revoke := diff(membership.Roles, current)
+	for _, role := range grant {
+		lr := l.With("role", role)
+		if !strings.HasPrefix(role, "pg_") {
+			if exists, err := processor.UserExists(ctx, db, role); err != nil {
+				lr.Errorw("could not determine if role exists", "error", err)
+				continue
+			} else if !exists {
+				if err := processor.CreateGroupRole(ctx, db, role); err != nil {
+					lr.Errorw("could not create group role", "error", err)
+					continue
+				}
+				changed(lr, "created group role")
+			}
+		}
+		if err := processor.GrantRole(ctx, db, role, membership.User); err != nil {
+			lr.Errorw("could not grant role membership", "error", err)
+		} else {
+			changed(lr, "granted role membership")
+		}
+	}
+	for _, role := range revoke {
+		lr := l.With("role", role)
+		if err := processor.RevokeRole(ctx, db, role, membership.User); err != nil {
+			lr.Errorw("could not revoke role membership", "error", err)
+		} else {
+			changed(lr, "revoked role membership")
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/henrywhitaker3/crunchy-users/internal/k8s"
+	"go.uber.org/zap"
+)
+
+// Database settings set by crunchy-users are recorded in this table
+// in the superuser's database, so only those are ever reset
+const databaseSettingsTable = `CREATE SCHEMA IF NOT EXISTS crunchy_users;
+CREATE TABLE IF NOT EXISTS crunchy_users.database_settings (
+	database text NOT NULL,
+	name text NOT NULL,
+	set_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (database, name)
+);`
+
+func (p *processor) RecordDatabaseSetting(ctx context.Context, db *sql.DB, database, name string) error {
+	if _, err := db.ExecContext(ctx, databaseSettingsTable); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(
+		ctx,
+		"INSERT INTO crunchy_users.database_settings (database, name) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		database,
+		name,
+	)
+	return err
+}
+
+func (p *processor) ForgetDatabaseSetting(ctx context.Context, db *sql.DB, database, name string) error {
+	if _, err := db.ExecContext(ctx, databaseSettingsTable); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(
+		ctx,
+		"DELETE FROM crunchy_users.database_settings WHERE database = $1 AND name = $2",
+		database,
+		name,
+	)
+	return err
+}
+
+// Returns the names of the settings crunchy-users has set, by the
+// database they were set for
+func (p *processor) RecordedDatabaseSettings(ctx context.Context, db *sql.DB) (map[string][]string, error) {
+	out := map[string][]string{}
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass('crunchy_users.database_settings') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return out, nil
+	}
+	rows, err := db.QueryContext(ctx, "SELECT database, name FROM crunchy_users.database_settings ORDER BY database, name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var database, name string
+		if err := rows.Scan(&database, &name); err != nil {
+			return nil, err
+		}
+		out[database] = append(out[database], name)
+	}
+	return out, rows.Err()
+}
+
+func (p *processor) DatabaseSettings(ctx context.Context, db *sql.DB, database string) (map[string]string, error) {
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT unnest(s.setconfig)
+		FROM pg_catalog.pg_db_role_setting s
+		JOIN pg_catalog.pg_database d ON d.oid = s.setdatabase
+		WHERE d.datname = $1 AND s.setrole = 0`,
+		database,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanSettings(rows)
+}
+
+func (p *processor) SetDatabaseSetting(ctx context.Context, db *sql.DB, database, name, value string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"ALTER DATABASE \"%s\" SET \"%s\" TO %s",
+		database,
+		name,
+		settingValue(value),
+	))
+	return err
+}
+
+func (p *processor) ResetDatabaseSetting(ctx context.Context, db *sql.DB, database, name string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("ALTER DATABASE \"%s\" RESET \"%s\"", database, name))
+	return err
+}
+
+// Sets and resets the database's configuration parameters so they
+// match the ones declared in the annotation. Only the settings in
+// recorded, which crunchy-users set before, are reset when they are
+// no longer declared, so ones set by hand are left alone.
+func handleDatabaseSettings(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	cluster k8s.ClusterResult,
+	settings k8s.DatabaseSettings,
+	recorded []string,
+) {
+	l := logger.With("database", settings.Database)
+	l.Debug("processing database settings")
+
+	if exists, err := processor.DatabaseExists(ctx, db, cluster.Key(), settings.Database); err != nil {
+		l.Errorw("could not determine if database exists", "error", err)
+		return
+	} else if !exists {
+		l.Debug("database does not exist, skipping")
+		return
+	}
+
+	current, err := processor.DatabaseSettings(ctx, db, settings.Database)
+	if err != nil {
+		l.Errorw("could not get database settings", "error", err)
+		return
+	}
+
+	set, _ := diffSettings(settings.Settings, current)
+	for _, name := range sortedKeys(settings.Settings) {
+		ls := l.With("setting", name, "value", settings.Settings[name])
+		if slices.Contains(set, name) {
+			if err := processor.SetDatabaseSetting(ctx, db, settings.Database, name, settings.Settings[name]); err != nil {
+				ls.Errorw("could not set database setting", "error", err)
+				continue
+			}
+			changed(ls, "set database setting")
+		}
+		if !slices.Contains(recorded, name) {
+			if err := processor.RecordDatabaseSetting(ctx, db, settings.Database, name); err != nil {
+				ls.Errorw("could not record database setting", "error", err)
+			}
+		}
+	}
+	for _, name := range recorded {
+		if _, ok := settings.Settings[name]; ok {
+			continue
+		}
+		ls := l.With("setting", name)
+		if _, ok := current[name]; ok {
+			if err := processor.ResetDatabaseSetting(ctx, db, settings.Database, name); err != nil {
+				ls.Errorw("could not reset database setting", "error", err)
+				continue
+			}
+			changed(ls, "reset database setting")
+		}
+		if err := processor.ForgetDatabaseSetting(ctx, db, settings.Database, name); err != nil {
+			ls.Errorw("could not forget reset database setting", "error", err)
+		}
+	}
+}
+
+func (p *processor) RoleSettings(ctx context.Context, db *sql.DB, user string) (map[string]map[string]string, error) {
+	rows, err := db.QueryContext(
+		ctx,
+		`SELECT COALESCE(d.datname, ''), unnest(s.setconfig)
+		FROM pg_catalog.pg_db_role_setting s
+		JOIN pg_catalog.pg_roles r ON r.oid = s.setrole
+		LEFT JOIN pg_catalog.pg_database d ON d.oid = s.setdatabase
+		WHERE r.rolname = $1`,
+		user,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string]map[string]string{}
+	for rows.Next() {
+		var database, setting string
+		if err := rows.Scan(&database, &setting); err != nil {
+			return nil, err
+		}
+		if _, ok := out[database]; !ok {
+			out[database] = map[string]string{}
+		}
+		name, value, _ := strings.Cut(setting, "=")
+		out[database][name] = value
+	}
+	return out, rows.Err()
+}
+
+func (p *processor) SetRoleSetting(ctx context.Context, db *sql.DB, user, database, name, value string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf(
+		"%s SET \"%s\" TO %s",
+		alterRoleIn(user, database),
+		name,
+		settingValue(value),
+	))
+	return err
+}
+
+func (p *processor) ResetRoleSetting(ctx context.Context, db *sql.DB, user, database, name string) error {
+	_, err := db.ExecContext(ctx, fmt.Sprintf("%s RESET \"%s\"", alterRoleIn(user, database), name))
+	return err
+}
+
+func alterRoleIn(user, database string) string {
+	query := fmt.Sprintf("ALTER ROLE \"%s\"", user)
+	if database != "" {
+		query = fmt.Sprintf("%s IN DATABASE \"%s\"", query, database)
+	}
+	return query
+}
+
+// Sets and resets the user's configuration parameters so they
+// match the ones declared in the annotation. Settings for a
+// database the user no longer has an entry for are all reset.
+func handleRoleSettings(
+	ctx context.Context,
+	logger *zap.SugaredLogger,
+	processor Processor,
+	db *sql.DB,
+	user string,
+	settings []k8s.RoleSettings,
+) {
+	logger.Debug("processing role settings")
+	current, err := processor.RoleSettings(ctx, db, user)
+	if err != nil {
+		logger.Errorw("could not get role settings", "error", err)
+		return
+	}
+
+	desired := map[string]map[string]string{}
+	for _, s := range settings {
+		if _, ok := desired[s.Database]; !ok {
+			desired[s.Database] = map[string]string{}
+		}
+		for name, value := range s.Settings {
+			desired[s.Database][name] = value
+		}
+	}
+	databases := sortedKeys(desired)
+	for _, database := range sortedKeys(current) {
+		if _, ok := desired[database]; !ok {
+			databases = append(databases, database)
+		}
+	}
+
+	for _, database := range databases {
+		l := logger.With("database", database)
+		set, reset := diffSettings(desired[database], current[database])
+		for _, name := range set {
+			ls := l.With("setting", name, "value", desired[database][name])
+			if err := processor.SetRoleSetting(ctx, db, user, database, name, desired[database][name]); err != nil {
+				ls.Errorw("could not set role setting", "error", err)
+			} else {
+				changed(ls, "set role setting")
+			}
+		}
+		for _, name := range reset {
+			ls := l.With("setting", name)
+			if err := processor.ResetRoleSetting(ctx, db, user, database, name); err != nil {
+				ls.Errorw("could not reset role setting", "error", err)
+			} else {
+				changed(ls, "reset role setting")
+			}
+		}
+	}
+}
+
+// Returns the names of the settings that need to be set, and
+// the names of the current settings that need to be reset
+func diffSettings(desired, current map[string]string) ([]string, []string) {
+	set := []string{}
+	for _, name := range sortedKeys(desired) {
+		value, ok := current[name]
+		if !ok || normaliseSetting(value) != normaliseSetting(desired[name]) {
+			set = append(set, name)
+		}
+	}
+	reset := []string{}
+	for _, name := range sortedKeys(current) {
+		if _, ok := desired[name]; !ok {
+			reset = append(reset, name)
+		}
+	}
+	return set, reset
+}
+
+func scanSettings(rows *sql.Rows) (map[string]string, error) {
+	defer rows.Close()
+	out := map[string]string{}
+	for rows.Next() {
+		var setting string
+		if err := rows.Scan(&setting); err != nil {
+			return nil, err
+		}
+		name, value, _ := strings.Cut(setting, "=")
+		out[name] = value
+	}
+	return out, rows.Err()
+}
+
+// Formats a setting's value as a list of string literals, so list
+// settings such as search_path get each element separately
+func settingValue(value string) string {
+	parts := []string{}
+	for _, part := range strings.Split(value, ",") {
+		parts = append(parts, fmt.Sprintf("'%s'", strings.ReplaceAll(strings.TrimSpace(part), "'", "''")))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func normaliseSetting(value string) string {
+	parts := []string{}
+	for _, part := range strings.Split(value, ",") {
+		parts = append(parts, strings.Trim(strings.TrimSpace(part), `"`))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/henrywhitaker3/crunchy-users/internal/logger"
+)
+
+// Serves the handler until the context is cancelled
+func Serve(ctx context.Context, addr string, handler http.Handler) {
+	l := logger.Logger(ctx).With("address", addr)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdown); err != nil {
+			l.Errorw("could not stop http server", "error", err)
+		}
+	}()
+
+	l.Infow("starting http server")
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		l.Errorw("http server stopped", "error", err)
+	}
+}